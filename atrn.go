@@ -0,0 +1,63 @@
+package smtp
+
+import (
+	"strings"
+)
+
+// parseAtrnDomains parses the domain list of the ATRN command, e.g.
+// "example.com,example.org".
+func parseAtrnDomains(arg string) ([]string, bool) {
+	if arg == "" {
+		return nil, true
+	}
+	var domains []string
+	for _, domain := range strings.Split(arg, ",") {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" || strings.ContainsAny(domain, " \t") {
+			return nil, false
+		}
+		domains = append(domains, domain)
+	}
+	return domains, true
+}
+
+// ATRN -> deliver queued mail with reversed roles (RFC 2645)
+func (c *Conn) handleAtrn(arg string) {
+	be, ok := c.server.backend.(ATRNBackend)
+	if !ok {
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, "ATRN command not implemented")
+		return
+	}
+	if !c.authenticated {
+		c.WriteResponse(530, EnhancedCodeSecurityError, "Authentication required")
+		return
+	}
+	if c.fromReceived {
+		c.WriteResponse(503, EnhancedCodeInvalidCommand, "ATRN not allowed during a mail transaction")
+		return
+	}
+	domains, ok := parseAtrnDomains(arg)
+	if !ok {
+		c.WriteResponse(501, EnhancedCodeInvalidArguments, "Was expecting ATRN arg syntax of [domain *(,domain)]")
+		return
+	}
+
+	state := c.State()
+	deliver, err := be.ATRN(&state, domains)
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+			return
+		}
+		c.WriteResponse(450, EnhancedCodeTempFailure, err.Error())
+		return
+	}
+
+	c.WriteResponse(250, EnhancedCodeOK, "OK now reversing the connection")
+	// Commands pipelined after ATRN are ignored
+	c.text.R.Discard(c.text.R.Buffered())
+	if err := deliver(c.conn); err != nil {
+		c.server.errorLog.Printf("ATRN delivery to %v failed: %v", state.RemoteAddr, err)
+	}
+	c.Close()
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"io"
+	"net"
+	"net/mail"
 )
 
 var (
@@ -47,6 +49,151 @@ type Backend interface {
 	AnonymousLogin(state *ConnectionState) (Session, error)
 }
 
+// An ExternalBackend is a Backend supporting the SASL EXTERNAL mechanism,
+// authenticating clients by their TLS client certificate. EXTERNAL is only
+// advertised and accepted if the client presented a certificate verified
+// by the ClientCAs of the TLS configuration.
+type ExternalBackend interface {
+	// LoginExternal authenticates a client by the certificate in
+	// state.TLS.VerifiedChains. identity is the authorization identity
+	// requested by the client, empty if the client wants to act as the
+	// identity of its certificate.
+	LoginExternal(state *ConnectionState, identity string) (Session, error)
+}
+
+// A PasswordBackend is a Backend which can look up the password of a user.
+// It enables the CRAM-MD5 mechanism, which needs the shared secret to verify
+// the client response. The session is created with Login.
+type PasswordBackend interface {
+	// GetPassword returns the password of username. Return an error if the
+	// user doesn't exist.
+	GetPassword(state *ConnectionState, username string) (string, error)
+}
+
+// A SessionRenewer is a Backend creating a new Session for a user who
+// already authenticated on the connection. It is needed to start a fresh
+// session for each transaction of authenticated clients when the
+// NewSessionPerTransaction option is set.
+type SessionRenewer interface {
+	RenewSession(state *ConnectionState, username string) (Session, error)
+}
+
+// An AvailabilityChecker is a Backend which can be temporarily overloaded,
+// e.g. because its queue is full. Transactions are refused while it is
+// unavailable, instead of accepting mail which can't be processed.
+type AvailabilityChecker interface {
+	// Available is called for every MAIL command before the Session sees
+	// the sender. Return an *SMTPError to refuse the transaction, usually
+	// 451. The connection is closed if the code is 421. Other errors are
+	// sent as 451.
+	Available(state *ConnectionState) error
+}
+
+// A ConnectionChecker is a Backend deciding whether to talk to a client at
+// all, e.g. by looking up its address in a blocklist.
+type ConnectionChecker interface {
+	// CheckConnection is called when a connection is accepted, after the
+	// reverse DNS lookup and before the greeting. Return an *SMTPError
+	// to send it in place of the greeting and close the connection,
+	// usually 554 5.7.1. Other errors are sent as 421.
+	CheckConnection(state *ConnectionState) error
+}
+
+// A HELOChecker is a Backend validating the domain announced with HELO,
+// EHLO or LHLO, e.g. to reject bare IP addresses or the server's own name.
+type HELOChecker interface {
+	// CheckHELO is called before the name is accepted. Return an
+	// *SMTPError to reject the command with a specific code, e.g.
+	// 550 5.7.1.
+	CheckHELO(state *ConnectionState, name string) error
+}
+
+// A SendLimiter is a Backend enforcing sending quotas, e.g. per
+// authenticated user as given in state.AuthenticatedUser. Return an
+// *SMTPError to reject the command with a specific code, e.g. 452 4.5.3 if
+// too many recipients were sent or 550 if the quota is exceeded.
+type SendLimiter interface {
+	// CheckSendLimit is called for MAIL before the sender is passed to the
+	// Session.
+	CheckSendLimit(state *ConnectionState, from string) error
+	// CheckRecipientLimit is called for RCPT before the recipient is passed
+	// to the Session. count is the number of recipients already accepted in
+	// the transaction.
+	CheckRecipientLimit(state *ConnectionState, from, to string, count int) error
+}
+
+// A SizeChecker is a Backend checking the message size declared with the
+// SIZE parameter of MAIL, e.g. to enforce a per-user limit. It is called in
+// addition to the MaxMessageBytes check, also if no maximum is set, but not
+// if the size is absent or 0. Return ErrInsufficientStorage if the storage
+// is temporarily full, or ErrDataTooLarge to reject the message permanently.
+type SizeChecker interface {
+	CheckSize(state *ConnectionState, from string, size int64) error
+}
+
+// An EnvelopeValidator is a Backend deferring the creation of the Session of
+// anonymous clients until a message arrives, e.g. because the Session setup
+// is expensive. MAIL and RCPT are checked with ValidateEnvelope instead of
+// the Session. When DATA or BDAT is received, the Session is created with
+// AnonymousLogin and Mail and Rcpt are called on it with the envelope. The
+// Session is then kept for the rest of the connection.
+type EnvelopeValidator interface {
+	// ValidateEnvelope checks the envelope of a transaction. It is called
+	// for MAIL with to empty and for every RCPT with all recipients
+	// including the new one. Return an *SMTPError to reject the command
+	// with a specific code.
+	ValidateEnvelope(state *ConnectionState, from string, to []string) error
+}
+
+// An ETRNBackend is a Backend starting queue runs requested with ETRN
+// (RFC 1985).
+type ETRNBackend interface {
+	// ETRN starts the delivery of the mail queued for node, which is a
+	// domain, "@domain" for the domain and its subdomains or "#queue" for
+	// a named queue. The client gets a 250 response on success. Return an
+	// *SMTPError to reply with a different code, e.g. 251 if there are no
+	// messages, 458 if the queue can't be started or 459 if the node is
+	// not allowed.
+	ETRN(state *ConnectionState, node string) error
+}
+
+// An ATRNBackend is a Backend delivering queued mail to authenticated
+// clients with ATRN (RFC 2645), reversing the roles of client and server.
+type ATRNBackend interface {
+	// ATRN is called for an authenticated client requesting the mail queued
+	// for domains, or for all its domains if domains is empty. It returns a
+	// function delivering the mail as SMTP client over conn, after which the
+	// connection is closed. Return an *SMTPError to refuse the request, e.g.
+	// 450 if a domain is not allowed or 453 if there is no mail.
+	ATRN(state *ConnectionState, domains []string) (deliver func(conn net.Conn) error, err error)
+}
+
+// A CapabilityProvider is a Backend advertising additional EHLO
+// capabilities per connection, e.g. depending on the TLS state. Capabilities
+// already advertised by the server are not repeated.
+type CapabilityProvider interface {
+	EHLOCapabilities(state *ConnectionState) []string
+}
+
+// A Verifier is a Backend answering the VRFY command. Without it the server
+// does not disclose whether an address exists, which prevents address
+// harvesting. Verify is only called for authenticated clients, anonymous
+// clients get the canned 252 response.
+type Verifier interface {
+	// Verify returns the lines of the 250 response for addr, usually the
+	// mailbox in the form "Full Name <user@example.com>". Return an
+	// *SMTPError to reply with a different code, e.g. 550 for an unknown user.
+	Verify(state *ConnectionState, addr string) ([]string, error)
+}
+
+// An Expander is a Backend answering the EXPN command. Expand is only called
+// for authenticated clients, anonymous clients get a 502 response.
+type Expander interface {
+	// Expand returns the members of the mailing list, one line per member.
+	// Return an *SMTPError to reply with a different code.
+	Expand(state *ConnectionState, list string) ([]string, error)
+}
+
 type Session interface {
 	// Discard currently processed message.
 	Reset()
@@ -62,12 +209,119 @@ type Session interface {
 	Data(r io.Reader, d DataContext) error
 }
 
+// MailOptions contains the parameters of the MAIL command.
+type MailOptions struct {
+	// Auth is the xtext decoded identity of the AUTH parameter (RFC 4954),
+	// the original submitter of a relayed message. It is only set if the
+	// client authenticated, empty if the identity is unknown.
+	Auth string
+	// RequireTLS is set if the message must only be relayed over TLS
+	// (RFC 8689).
+	RequireTLS bool
+	// Size is the message size declared with the SIZE parameter (RFC 1870),
+	// 0 if the size is absent or unknown.
+	Size int64
+	// Params contains all parameters, the keys are uppercased.
+	Params map[string]string
+}
+
+// MailWithOptions can be implemented by a Session to receive the parameters
+// of the MAIL command. It is called instead of Session.Mail.
+type MailWithOptions interface {
+	MailWithOptions(from string, opts *MailOptions) error
+}
+
+// ResetReason indicates why the transaction of a session is reset.
+type ResetReason int
+
+const (
+	// ResetCommand is an explicit RSET command of the client.
+	ResetCommand ResetReason = iota
+	// ResetTransactionEnd follows a finished or failed message transfer.
+	ResetTransactionEnd
+	// ResetTLS follows the STARTTLS handshake.
+	ResetTLS
+	// ResetXClient follows an XCLIENT command.
+	ResetXClient
+)
+
+// ResetWithReason can be implemented by a Session to learn why it is reset,
+// e.g. to count transactions abandoned by the client. It is called instead
+// of Session.Reset.
+type ResetWithReason interface {
+	ResetWithReason(reason ResetReason)
+}
+
+// RcptOptions contains the parameters of the RCPT command.
+type RcptOptions struct {
+	// Notify contains the values of the NOTIFY parameter (RFC 3461), e.g.
+	// SUCCESS and FAILURE.
+	Notify []string
+	// OriginalRecipient is the xtext decoded ORCPT parameter (RFC 3461),
+	// e.g. "rfc822;user@example.com".
+	OriginalRecipient string
+	// Params contains all parameters, the keys are uppercased.
+	Params map[string]string
+}
+
+// RcptWithOptions can be implemented by a Session to receive the parameters
+// of the RCPT command. It is called instead of Session.Rcpt.
+type RcptWithOptions interface {
+	RcptWithOptions(to string, opts *RcptOptions) error
+}
+
 type DataContext interface {
-	// SetStatus is used for LMTP only to set the answer for an Recipient
+	// SetStatus is used for LMTP only to set the answer for an Recipient.
+	// It is ignored for recipients whose delivery wasn't started.
 	SetStatus(rcpt string, status *SMTPError)
+	// SetRecipientResult records the delivery result of a recipient, nil
+	// means success. It doesn't change the response to the message, the
+	// results are passed to the OnRecipientResults hook for logging. It is
+	// safe to call concurrently.
+	SetRecipientResult(rcpt string, status *SMTPError)
+	// BytesRead returns the number of message bytes read by the backend so
+	// far.
+	BytesRead() int64
 	// SetSMTPResponse can be used to overwrite default SMTP Accept Message after DATA finished (not for LMTP)
 	SetSMTPResponse(response *SMTPError)
+	// WriteResponse sets a multi-line response sent after DATA finished if
+	// Data returns nil, e.g. a 250 response with a tracking ID on a separate
+	// line. It replaces a response set by SetSMTPResponse (not for LMTP).
+	WriteResponse(code int, enhCode EnhancedCode, lines ...string)
+	// StartDelivery is used for LMTP only, it must be called for every
+	// recipient during Data before its status is set with SetStatus. The
+	// server waits for the status until ctx is done. Recipients whose
+	// delivery wasn't started get a 451 response, or the error returned by
+	// Data.
 	StartDelivery(ctx context.Context, rcpt string)
+	// MultiDeliver is a convenience for LMTP backends delivering a message
+	// to each recipient in turn. It reads the message, spooling large
+	// messages to a temporary file, and calls deliver for every recipient
+	// with a reader positioned at the beginning of the message. The returned
+	// SMTPError is used as status of the recipient, nil means success.
+	// StartDelivery and SetStatus are called by MultiDeliver.
+	MultiDeliver(deliver func(rcpt string, r io.Reader) *SMTPError) error
+	// BinaryMIME reports whether the message was declared BODY=BINARYMIME
+	// and received with BDAT. The message is raw binary data, it must not
+	// be interpreted line by line.
+	BinaryMIME() bool
+	// RequireTLS reports whether the message was sent with the REQUIRETLS
+	// parameter (RFC 8689). It must then only be relayed over TLS with a
+	// verified certificate, otherwise it has to be bounced.
+	RequireTLS() bool
+	// ParseMessage reads the header of the message and returns it as
+	// mail.Message. The body is not read, it can be streamed from the Body
+	// field. The size limit of the server applies.
+	ParseMessage() (*mail.Message, error)
+	// Heartbeat resets the write deadline of the connection. Backends doing
+	// long running processing, e.g. a synchronous virus scan, can call it
+	// periodically so the final response isn't hit by the WriteTimeout.
+	Heartbeat()
 	GetXForward() XForward
 	GetHelo() string
+	// BuildReceivedHeader returns a Received header field (including the
+	// trailing CRLF) for the current message, by is the name of the
+	// receiving host and defaults to the SNI host name requested by the
+	// client or the server's domain.
+	BuildReceivedHeader(by string) string
 }
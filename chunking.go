@@ -0,0 +1,220 @@
+package smtp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// bdatState holds a message being received with BDAT. The chunks are
+// written to a pipe read by Session.Data.
+type bdatState struct {
+	pw          *io.PipeWriter
+	dataContext *dataContext
+	received    int64
+	start       time.Time
+	deadline    time.Time  // Deadline set by MaxDataDuration, zero means unset
+	done        chan error // result of Session.Data
+	header      headerCounter
+	err         *SMTPError // Header size error, the rest of the chunk is discarded
+}
+
+// Write writes a chunk to the pipe, checking the size of the header.
+func (bdat *bdatState) Write(b []byte) (int, error) {
+	if bdat.err != nil {
+		return len(b), nil
+	}
+	if _, ok := bdat.header.count(b); !ok {
+		bdat.err = ErrDataHeaderTooLarge
+		return len(b), nil
+	}
+	return bdat.pw.Write(b)
+}
+
+func (c *Conn) startBdat() *bdatState {
+	pr, pw := io.Pipe()
+	bdat := &bdatState{
+		pw:          pw,
+		dataContext: c.newDataContext(pr),
+		start:       time.Now(),
+		done:        make(chan error, 1),
+		header:      headerCounter{max: c.server.maxHeaderBytes},
+	}
+	if c.server.maxDataDuration > 0 {
+		bdat.deadline = bdat.start.Add(c.server.maxDataDuration)
+	}
+	c.transactionStart("BDAT")
+	session := c.Session()
+	go func() {
+		err := session.Data(bdat.dataContext.r, bdat.dataContext)
+		// Consume the chunks the backend didn't read
+		io.Copy(ioutil.Discard, pr)
+		bdat.done <- err
+	}()
+
+	c.locker.Lock()
+	c.bdat = bdat
+	c.locker.Unlock()
+	return bdat
+}
+
+// abortBdat aborts the message being received with BDAT, if any.
+func (c *Conn) abortBdat() {
+	c.locker.Lock()
+	bdat := c.bdat
+	c.bdat = nil
+	c.locker.Unlock()
+
+	if bdat != nil {
+		bdat.pw.CloseWithError(io.ErrUnexpectedEOF)
+		c.transactionEnd(bdat.start, false, bdat.received)
+	}
+}
+
+// discardChunk discards the chunk of a rejected BDAT command. If the chunk
+// can't be read, the connection is closed and false is returned.
+func (c *Conn) discardChunk(size int64) bool {
+	if _, err := io.CopyN(ioutil.Discard, c.text.R, size); err != nil {
+		c.Close()
+		return false
+	}
+	return true
+}
+
+// chunkReader reads a BDAT chunk, applying the DataTimeout and the
+// MaxDataDuration deadline of the message.
+type chunkReader struct {
+	r        io.Reader
+	conn     net.Conn
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if err := setMessageDeadline(r.conn, r.timeout, r.deadline); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(b)
+	if deadlineExceeded(err, r.deadline) {
+		return n, ErrDataDurationExceeded
+	}
+	return n, err
+}
+
+// readChunk writes a chunk of size bytes to the message.
+func (c *Conn) readChunk(bdat *bdatState, size int64) error {
+	if !bdat.deadline.IsZero() && !time.Now().Before(bdat.deadline) {
+		return ErrDataDurationExceeded
+	}
+	r := &chunkReader{
+		r:        c.text.R,
+		conn:     c.conn,
+		timeout:  c.server.dataTimeout,
+		deadline: bdat.deadline,
+	}
+	_, err := io.CopyN(bdat, r, size)
+	if c.server.dataTimeout > 0 || c.server.maxDataDuration > 0 {
+		// Clear the deadline of the message
+		c.conn.SetReadDeadline(time.Time{})
+	}
+	return err
+}
+
+// rejectBdat aborts the message being received with BDAT after a chunk
+// was rejected with err.
+func (c *Conn) rejectBdat(bdat *bdatState, err *SMTPError, bytes int64) {
+	bdat.pw.CloseWithError(err)
+	<-bdat.done
+	c.WriteResponse(err.Code, err.EnhancedCode, err.responseMessage())
+
+	c.locker.Lock()
+	c.bdat = nil
+	c.locker.Unlock()
+	c.transactionEnd(bdat.start, false, bytes)
+	c.reset(ResetTransactionEnd)
+}
+
+// BDAT state -> receiving message chunks (RFC 3030)
+func (c *Conn) handleBdat(arg string) {
+	args := strings.Fields(arg)
+	if len(args) == 0 || len(args) > 2 {
+		c.WriteResponse(501, EnhancedCodeInvalidArguments, "Was expecting BDAT arg syntax of BDAT <size> [LAST]")
+		return
+	}
+	size, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || size < 0 {
+		c.WriteResponse(501, EnhancedCodeInvalidArguments, "Was expecting BDAT arg syntax of BDAT <size> [LAST]")
+		return
+	}
+
+	// The chunk has to be consumed even if the command is rejected
+	last := len(args) == 2
+	if last && !strings.EqualFold(args[1], "LAST") {
+		if c.discardChunk(size) {
+			c.WriteResponse(501, EnhancedCodeInvalidArguments, "Was expecting BDAT arg syntax of BDAT <size> [LAST]")
+		}
+		return
+	}
+	if !c.fromReceived || len(c.recipients) == 0 {
+		if c.discardChunk(size) {
+			c.WriteResponse(503, EnhancedCodeInvalidCommand, "Missing RCPT TO command.")
+		}
+		return
+	}
+
+	c.locker.Lock()
+	bdat := c.bdat
+	c.locker.Unlock()
+	if bdat == nil {
+		if err := c.startLazySession(); err != nil {
+			if c.discardChunk(size) {
+				c.WriteResponse(err.Code, err.EnhancedCode, err.responseMessage())
+				c.reset(ResetTransactionEnd)
+			}
+			return
+		}
+		bdat = c.startBdat()
+	}
+
+	if max := atomic.LoadInt64(&c.server.maxMessageBytes); max > 0 && bdat.received+size > max {
+		if c.discardChunk(size) {
+			c.rejectBdat(bdat, ErrDataTooLarge, bdat.received+size)
+		}
+		return
+	}
+
+	if err := c.readChunk(bdat, size); err != nil {
+		if err == ErrDataDurationExceeded {
+			c.rejectBdat(bdat, ErrDataDurationExceeded, bdat.received)
+		}
+		c.Close()
+		return
+	}
+	bdat.received += size
+	if bdat.err != nil {
+		c.rejectBdat(bdat, bdat.err, bdat.received)
+		return
+	}
+
+	if !last {
+		c.WriteResponse(250, EnhancedCodeOK, fmt.Sprintf("%v octets received", size))
+		return
+	}
+
+	bdat.pw.Close()
+	err = <-bdat.done
+
+	c.locker.Lock()
+	c.bdat = nil
+	c.locker.Unlock()
+
+	accepted := c.writeDataResponse(bdat.dataContext, err)
+	c.recipientResults(bdat.dataContext)
+	c.transactionEnd(bdat.start, accepted, bdat.received)
+	c.reset(ResetTransactionEnd)
+}
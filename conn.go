@@ -6,19 +6,58 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
+	"net/mail"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// TLSMode indicates how TLS was established on a connection.
+type TLSMode int
+
+const (
+	// TLSNone is an unencrypted connection.
+	TLSNone TLSMode = iota
+	// TLSImplicit is a connection encrypted from the start, e.g. on port
+	// 465 with ListenAndServeTLS.
+	TLSImplicit
+	// TLSStartTLS is a connection upgraded with the STARTTLS command.
+	TLSStartTLS
 )
 
 type ConnectionState struct {
 	Hostname   string
 	RemoteAddr net.Addr
 	TLS        tls.ConnectionState
+	// TLSMode indicates whether TLS was established with STARTTLS or
+	// implicitly.
+	TLSMode TLSMode
+	// ReverseDNS contains the PTR records of the remote address, if the
+	// EnableReverseDNS option is set.
+	ReverseDNS []string
+	// AuthenticatedUser is the user name the client authenticated as,
+	// empty for anonymous clients.
+	AuthenticatedUser string
+	// ServerName is the host name requested by the client with SNI during
+	// the TLS handshake, empty if none was sent.
+	ServerName string
+}
+
+// Transaction is a snapshot of the mail transaction in progress on a Conn.
+type Transaction struct {
+	// From is the sender, after MailFromRewrite was applied.
+	From string
+	// Recipients contains the lowercased recipients accepted so far.
+	Recipients []string
+	// FromReceived reports whether the MAIL command was accepted.
+	FromReceived bool
 }
 
 type Conn struct {
@@ -26,25 +65,55 @@ type Conn struct {
 	text          *TextConn
 	server        *Server
 	helo          string
+	ehlo          bool
+	reverseDNS    []string
+	fcrdns        []string // forward-confirmed reverse DNS names
 	nbrErrors     int
+	nbrNoops      int // commands without progress since the last message
 	session       Session
+	authenticated bool
+	startTLS      bool // whether TLS was established with STARTTLS
+	authUser      string
+	authAttempt   string // user name given in the current AUTH attempt
 	locker        sync.Mutex
 	XForward      *XForward
+	XClient       *XClient
 	fromReceived  bool
+	rawMailFrom   string
+	mailFrom      string        // sender passed to the Session or EnvelopeValidator
+	mailOpts      *MailOptions  // parameters of the MAIL command
+	pendingRcpts  []pendingRcpt // recipients of a lazily created Session
+	binaryMIME    bool
+	bdat          *bdatState // message being received with BDAT
+	utf8          bool
 	recipients    []string
 	recipientsmap map[string]struct{}
+	closed        bool
+}
+
+// pendingRcpt is a recipient validated by an EnvelopeValidator, it is
+// passed to the Session when it is created.
+type pendingRcpt struct {
+	to   string
+	opts *RcptOptions
 }
 
 type XForward struct {
 	Name, Addr, Proto, Helo string
 }
 
+// XClient holds the attributes received with the XCLIENT command.
+type XClient struct {
+	Name, Addr, Port, Proto, Helo, Login string
+}
+
 func newConn(c net.Conn, s *Server) *Conn {
 	sc := &Conn{
 		server:        s,
 		conn:          c,
 		recipientsmap: make(map[string]struct{}),
 		XForward:      new(XForward),
+		XClient:       new(XClient),
 	}
 
 	sc.init()
@@ -66,17 +135,42 @@ func (c *Conn) init() {
 	}
 
 	//c.text = textproto.NewConn(rwc)
-	c.text = NewTextConn(rwc)
+	if c.server.readBufferSize > 0 && c.server.writeBufferSize > 0 {
+		c.text = NewTextConnSize(rwc, c.server.readBufferSize, c.server.writeBufferSize)
+	} else {
+		c.text = NewTextConn(rwc)
+	}
+	c.text.maxLineLength = c.server.maxLineLength
+	c.text.rejectBareLF = c.server.rejectBareLF || c.server.strict
+	c.text.strictDot = c.server.strict
 }
 
 func (c *Conn) unrecognizedCommand(cmd string) {
-	c.WriteResponse(500, EnhancedCode{5, 5, 2}, fmt.Sprintf("Syntax error, %v command unrecognized", cmd))
+	c.WriteResponse(500, EnhancedCodeSyntaxError, fmt.Sprintf("Syntax error, %v command unrecognized", cmd))
+	c.countError()
+}
 
+// countError counts a protocol error of the client. If the client exceeds
+// the MaxErrors limit, the connection is closed.
+func (c *Conn) countError() {
 	c.nbrErrors++
-	if c.nbrErrors > 3 {
-		c.WriteResponse(500, EnhancedCode{5, 5, 2}, "Too many unrecognized commands")
+	if c.server.maxErrors > 0 && c.nbrErrors > c.server.maxErrors {
+		c.WriteResponse(421, EnhancedCodeTempSecurityError, "Too many errors, closing connection")
+		c.Close()
+	}
+}
+
+// countNoop counts a command without progress and closes the connection if
+// there were too many of them. It reports whether the command can be
+// handled.
+func (c *Conn) countNoop() bool {
+	c.nbrNoops++
+	if c.server.maxNoops > 0 && c.nbrNoops > c.server.maxNoops {
+		c.WriteResponse(421, EnhancedCodeTempSecurityError, "Too many commands without progress, closing connection")
 		c.Close()
+		return false
 	}
+	return true
 }
 
 // Commands are dispatched to the appropriate handler functions.
@@ -85,7 +179,13 @@ func (c *Conn) handle(cmd string, arg string) {
 	// and close connection.
 	defer func() {
 		if err := recover(); err != nil {
-			c.WriteResponse(421, EnhancedCode{4, 0, 0}, "Internal server error")
+			if c.server.panicHandler != nil {
+				c.server.panicHandler(c, cmd, err)
+				c.Close()
+				return
+			}
+
+			c.WriteResponse(421, EnhancedCodeTempFailure, "Internal server error")
 			c.Close()
 
 			stack := debug.Stack()
@@ -94,23 +194,38 @@ func (c *Conn) handle(cmd string, arg string) {
 	}()
 
 	if cmd == "" {
-		c.WriteResponse(500, EnhancedCode{5, 5, 2}, "Speak up")
+		c.WriteResponse(500, EnhancedCodeSyntaxError, "Speak up")
 		return
 	}
 
 	cmd = strings.ToUpper(cmd)
+	if c.server.commandInterceptor != nil && c.server.commandInterceptor(c, cmd, arg) {
+		return
+	}
+	if c.server.disabledCommands[cmd] {
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, fmt.Sprintf("%v command disabled", cmd))
+		return
+	}
+
 	switch cmd {
-	case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
+	case "NOOP", "RSET", "HELO", "EHLO", "LHLO":
+		if !c.countNoop() {
+			return
+		}
+	}
+
+	switch cmd {
+	case "SEND", "SOML", "SAML", "HELP", "TURN":
 		// These commands are not implemented in any state
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%v command not implemented", cmd))
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, fmt.Sprintf("%v command not implemented", cmd))
 	case "HELO", "EHLO", "LHLO":
 		lmtp := cmd == "LHLO"
 		enhanced := lmtp || cmd == "EHLO"
 		if c.server.lmtp && !lmtp {
-			c.WriteResponse(500, EnhancedCode{5, 5, 1}, "This is a LMTP server, use LHLO")
+			c.WriteResponse(500, EnhancedCodeInvalidCommand, "This is a LMTP server, use LHLO")
 		}
 		if !c.server.lmtp && lmtp {
-			c.WriteResponse(500, EnhancedCode{5, 5, 1}, "This is not a LMTP server")
+			c.WriteResponse(500, EnhancedCodeInvalidCommand, "This is not a LMTP server")
 		}
 		c.handleGreet(enhanced, arg)
 	case "XFORWARD":
@@ -119,21 +234,54 @@ func (c *Conn) handle(cmd string, arg string) {
 		} else {
 			c.handleXForward(arg)
 		}
+	case "XCLIENT":
+		if !c.server.allowXClient {
+			c.unrecognizedCommand(cmd)
+		} else {
+			c.handleXClient(arg)
+		}
 	case "MAIL":
 		c.handleMail(arg)
 	case "RCPT":
 		c.handleRcpt(arg)
 	case "VRFY":
-		c.WriteResponse(252, EnhancedCode{2, 5, 0}, "Cannot VRFY user, but will accept message")
+		c.handleVrfy(arg)
+	case "EXPN":
+		c.handleExpn(arg)
 	case "NOOP":
-		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "I have sucessfully done nothing")
+		c.WriteResponse(250, EnhancedCodeOK, c.server.messages.Noop)
 	case "RSET": // Reset session
-		c.reset()
-		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "Session reset")
+		discarded := len(c.recipients)
+		c.reset(ResetCommand)
+		if c.server.verboseRset {
+			c.WriteResponse(250, EnhancedCodeAddressOK, fmt.Sprintf("Flushed (%d recipients discarded)", discarded))
+		} else {
+			c.WriteResponse(250, EnhancedCodeOK, "Session reset")
+		}
 	case "DATA":
 		c.handleData(arg)
+	case "BDAT":
+		if c.server.chunking {
+			c.handleBdat(arg)
+		} else {
+			c.unrecognizedCommand(cmd)
+		}
+	case "ETRN":
+		if c.server.etrn {
+			c.handleEtrn(arg)
+		} else {
+			c.unrecognizedCommand(cmd)
+		}
+	case "ATRN":
+		if c.server.atrn {
+			c.handleAtrn(arg)
+		} else {
+			c.unrecognizedCommand(cmd)
+		}
 	case "QUIT":
-		c.WriteResponse(221, EnhancedCode{2, 0, 0}, "Goodnight and good luck")
+		c.WriteResponse(221, EnhancedCodeOK, c.server.messages.Quit)
+		// Commands pipelined after QUIT are ignored
+		c.text.R.Discard(c.text.R.Buffered())
 		c.Close()
 	case "AUTH":
 		if c.server.authDisabled {
@@ -165,14 +313,60 @@ func (c *Conn) SetSession(session Session) {
 	c.session = session
 }
 
+// Transaction returns a copy of the current mail transaction. It is safe to
+// call from other goroutines, e.g. within Server.ForEachConn.
+func (c *Conn) Transaction() Transaction {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return Transaction{
+		From:         c.mailFrom,
+		Recipients:   append([]string(nil), c.recipients...),
+		FromReceived: c.fromReceived,
+	}
+}
+
+// AuthenticatedUser returns the user name the client authenticated as, or
+// an empty string if the client didn't authenticate.
+func (c *Conn) AuthenticatedUser() string {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.authUser
+}
+
+// SetAuthenticatedUser records the user name the client authenticated as.
+// It is called by the built-in SASL mechanisms, custom mechanisms added with
+// EnableAuth should call it along with SetSession.
+func (c *Conn) SetAuthenticatedUser(username string) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	c.authUser = username
+}
+
 func (c *Conn) Close() error {
-	if session := c.Session(); session != nil {
+	c.locker.Lock()
+	if c.closed {
+		c.locker.Unlock()
+		return nil
+	}
+	c.closed = true
+	session := c.session
+	c.locker.Unlock()
+
+	c.abortBdat()
+
+	if session != nil {
 		session.Logout()
 	}
 
 	return c.conn.Close()
 }
 
+func (c *Conn) isClosed() bool {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	return c.closed
+}
+
 // TLSConnectionState returns the connection's TLS connection state.
 // Zero values are returned if the connection doesn't use TLS.
 func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
@@ -188,38 +382,219 @@ func (c *Conn) State() ConnectionState {
 	tlsState, ok := c.TLSConnectionState()
 	if ok {
 		state.TLS = tlsState
+		state.ServerName = tlsState.ServerName
+		state.TLSMode = TLSImplicit
+		if c.startTLS {
+			state.TLSMode = TLSStartTLS
+		}
 	}
 
 	state.Hostname = c.helo
+	state.ReverseDNS = c.reverseDNS
+	state.AuthenticatedUser = c.AuthenticatedUser()
 	state.RemoteAddr = c.conn.RemoteAddr()
+	if addr := c.XClient.remoteAddr(); addr != nil {
+		state.RemoteAddr = addr
+	}
 
 	return state
 }
 
+// domain returns the host name the server announces itself as: the SNI
+// host name requested by a TLS client, or the configured Domain. The SNI
+// name is chosen by the client and only used if it is a valid host name.
+func (c *Conn) domain() string {
+	if tlsState, ok := c.TLSConnectionState(); ok && isHostname(tlsState.ServerName) {
+		return tlsState.ServerName
+	}
+	return c.server.domain
+}
+
+// isHostname reports whether name is a syntactically valid DNS host name,
+// i.e. dot separated labels of letters, digits and hyphens.
+func isHostname(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// externalAllowed reports whether the SASL EXTERNAL mechanism can be used:
+// the backend supports it and the client presented a TLS certificate
+// verified by the server.
+func (c *Conn) externalAllowed() bool {
+	if _, ok := c.server.backend.(ExternalBackend); !ok {
+		return false
+	}
+	state, isTLS := c.TLSConnectionState()
+	return isTLS && len(state.VerifiedChains) > 0
+}
+
+// cramMD5Allowed reports whether the CRAM-MD5 mechanism can be used: the
+// backend supports it and authentication is allowed on this connection.
+func (c *Conn) cramMD5Allowed() bool {
+	_, ok := c.server.backend.(PasswordBackend)
+	return ok && c.authAllowed()
+}
+
+// tlsRequired reports whether the command must be rejected because
+// RequireTLS is set and the connection is not encrypted.
+func (c *Conn) tlsRequired() bool {
+	_, isTLS := c.TLSConnectionState()
+	if c.server.requireTLS && !isTLS {
+		c.WriteResponse(530, EnhancedCodeSecurityError, "Must issue a STARTTLS command first")
+		return true
+	}
+	return false
+}
+
 func (c *Conn) authAllowed() bool {
 	_, isTLS := c.TLSConnectionState()
 	return !c.server.authDisabled && (isTLS || c.server.allowInsecureAuth)
 }
 
+// addrIP returns the IP address of addr, or nil if it has none, e.g. for
+// unix sockets. Other transports than TCP are supported as long as the
+// string form of their address is "host:port" or an IP address.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	}
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return net.ParseIP(host)
+}
+
+// lookupReverseDNS resolves the PTR records of the remote address. Errors are
+// ignored, the lookup is bounded by the read timeout.
+func (c *Conn) lookupReverseDNS() {
+	ip := addrIP(c.conn.RemoteAddr())
+	if ip == nil {
+		return
+	}
+
+	timeout := c.server.readTimeout
+	if timeout == 0 {
+		timeout = defaultLookupTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	names, err := c.server.resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return
+	}
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+	c.reverseDNS = names
+
+	if c.server.fcrdns == nil {
+		return
+	}
+	for _, name := range names {
+		addrs, err := c.server.resolver.LookupHost(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if resolved := net.ParseIP(a); resolved != nil && resolved.Equal(ip) {
+				c.fcrdns = append(c.fcrdns, name)
+				break
+			}
+		}
+	}
+}
+
+// checkFCrDNS enforces the FCrDNS policy of the server. If the client is
+// rejected, a 550 response is written and false is returned.
+func (c *Conn) checkFCrDNS() bool {
+	policy := c.server.fcrdns
+	if policy == nil {
+		return true
+	}
+
+	ok := len(c.fcrdns) > 0
+	if ok && policy.MatchHelo {
+		ok = false
+		for _, name := range c.fcrdns {
+			if strings.EqualFold(name, c.helo) {
+				ok = true
+				break
+			}
+		}
+	}
+	if !ok {
+		c.WriteResponse(550, EnhancedCodeReverseDNSFailed, "Reverse DNS validation failed")
+	}
+	return ok
+}
+
+// checkHELO validates the announced domain with the HELOChecker of the
+// backend, if any. It reports whether the domain was accepted.
+func (c *Conn) checkHELO(domain string) bool {
+	checker, ok := c.server.backend.(HELOChecker)
+	if !ok {
+		return true
+	}
+	state := c.State()
+	if err := checker.CheckHELO(&state, domain); err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+		} else {
+			c.WriteResponse(451, EnhancedCodeTempFailure, err.Error())
+		}
+		return false
+	}
+	return true
+}
+
 // GREET state -> waiting for HELO
 func (c *Conn) handleGreet(enhanced bool, arg string) {
 	if !enhanced {
 		domain, err := parseHelloArgument(arg)
 		if err != nil {
-			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for HELO")
+			c.WriteResponse(501, EnhancedCodeSyntaxError, "Domain/address argument required for HELO")
+			return
+		}
+		if !c.checkHELO(domain) {
 			return
 		}
 		c.helo = domain
+		c.ehlo = false
 
-		c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Hello %s", domain))
+		c.WriteResponse(250, EnhancedCodeOK, fmt.Sprintf("Hello %s", domain))
 	} else {
 		domain, err := parseHelloArgument(arg)
 		if err != nil {
-			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for EHLO")
+			c.WriteResponse(501, EnhancedCodeSyntaxError, "Domain/address argument required for EHLO")
+			return
+		}
+		if !c.checkHELO(domain) {
 			return
 		}
 
 		c.helo = domain
+		c.ehlo = true
 
 		caps := []string{}
 		caps = append(caps, c.server.caps...)
@@ -227,19 +602,58 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 			caps = append(caps, "STARTTLS")
 		}
 		if c.authAllowed() {
-			authCap := "AUTH"
-			for name := range c.server.auths {
-				authCap += " " + name
+			mechs := c.server.AuthMechanisms()
+			if c.cramMD5Allowed() {
+				mechs = append(mechs, cramMD5)
 			}
+			if c.externalAllowed() {
+				mechs = append(mechs, sasl.External)
+			}
+			sort.Strings(mechs)
 
-			caps = append(caps, authCap)
+			caps = append(caps, "AUTH "+strings.Join(mechs, " "))
+		}
+		if max := atomic.LoadInt64(&c.server.maxMessageBytes); max > 0 {
+			caps = append(caps, fmt.Sprintf("SIZE %v", max))
+		}
+		if c.server.chunking {
+			caps = append(caps, "CHUNKING")
+		}
+		if c.server.binaryMIME {
+			caps = append(caps, "BINARYMIME")
 		}
-		if c.server.maxMessageBytes > 0 {
-			caps = append(caps, fmt.Sprintf("SIZE %v", c.server.maxMessageBytes))
+		if c.server.smtputf8 {
+			caps = append(caps, "SMTPUTF8")
+		}
+		if _, isTLS := c.TLSConnectionState(); c.server.requireTLSExt && isTLS {
+			caps = append(caps, "REQUIRETLS")
+		}
+		if c.server.atrn {
+			caps = append(caps, "ATRN")
+		}
+		if c.server.etrn {
+			caps = append(caps, "ETRN")
 		}
 		if c.server.allowXForward {
 			caps = append(caps, "XFORWARD NAME ADDR PROTO HELO")
 		}
+		if c.server.allowXClient {
+			caps = append(caps, "XCLIENT NAME ADDR PORT PROTO HELO LOGIN")
+		}
+		if provider, ok := c.server.backend.(CapabilityProvider); ok {
+			state := c.State()
+			caps = append(caps, provider.EHLOCapabilities(&state)...)
+		}
+
+		caps = uniqueCaps(caps)
+		for i := 0; i < len(caps); i++ {
+			// Don't advertise extensions of disabled commands, e.g. STARTTLS
+			if c.server.disabledCommands[strings.SplitN(caps[i], " ", 2)[0]] {
+				caps = append(caps[:i], caps[i+1:]...)
+				i--
+			}
+		}
+		sort.Strings(caps)
 
 		args := []string{"Hello " + domain}
 		args = append(args, caps...)
@@ -247,45 +661,177 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	}
 }
 
+// uniqueCaps removes capabilities advertised more than once, only the first
+// capability with the same keyword is kept. Keywords are uppercased.
+func uniqueCaps(caps []string) []string {
+	seen := make(map[string]struct{}, len(caps))
+	unique := caps[:0]
+	for _, cap := range caps {
+		parts := strings.SplitN(cap, " ", 2)
+		keyword := strings.ToUpper(parts[0])
+		if _, ok := seen[keyword]; ok {
+			continue
+		}
+		seen[keyword] = struct{}{}
+		parts[0] = keyword
+		unique = append(unique, strings.Join(parts, " "))
+	}
+	return unique
+}
+
 // handleXForward client send xforward infos
 func (c *Conn) handleXForward(arg string) {
 	// arg can be          NAME=example.com ADDR=192.168.0.1 PROTO=ESMTP
 	// or/and just         HELO=mail.example.com
-	args := strings.Split(arg, " ")
-	for _, a := range args {
-		kv := strings.Split(a, "=")
+	if arg == "" {
+		c.WriteResponse(501, EnhancedCodeInvalidArguments, "Missing XFORWARD attributes")
+		return
+	}
+	xforward := *c.XForward
+	for _, a := range strings.Fields(arg) {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			c.WriteResponse(501, EnhancedCodeInvalidArguments, "Bad command parameter syntax")
+			return
+		}
+		value, err := decodeXtext(kv[1])
+		if err != nil {
+			c.WriteResponse(501, EnhancedCodeInvalidArguments, "Bad command parameter syntax")
+			return
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			value = ""
+		}
 		switch strings.ToUpper(kv[0]) {
 		case "NAME":
-			c.XForward.Name = kv[1]
+			xforward.Name = value
 		case "ADDR":
-			c.XForward.Addr = kv[1]
+			xforward.Addr = value
 		case "PROTO":
-			c.XForward.Proto = kv[1]
+			xforward.Proto = value
 		case "HELO":
-			c.XForward.Helo = kv[1]
+			xforward.Helo = value
 		default:
-			c.WriteResponse(501, EnhancedCode{2, 5, 1}, "Bad command parameter syntax")
+			c.WriteResponse(501, EnhancedCodeInvalidArguments, "Bad command parameter syntax")
 			return
 		}
 	}
-	c.WriteResponse(250, EnhancedCode{2, 0, 0}, "Ok")
+	*c.XForward = xforward
+	c.WriteResponse(250, EnhancedCodeOK, "Ok")
+}
+
+// handleXClient client send xclient infos, the session is restarted afterwards
+func (c *Conn) handleXClient(arg string) {
+	// arg can be          NAME=example.com ADDR=192.168.0.1 PORT=4711
+	// or/and              PROTO=ESMTP HELO=mail.example.com LOGIN=user
+	if c.fromReceived {
+		c.WriteResponse(503, EnhancedCodeInvalidCommand, "XCLIENT not allowed during a mail transaction")
+		return
+	}
+	xclient := *c.XClient
+	for _, a := range strings.Fields(arg) {
+		kv := strings.SplitN(a, "=", 2)
+		if len(kv) != 2 {
+			c.WriteResponse(501, EnhancedCodeInvalidArguments, "Bad command parameter syntax")
+			return
+		}
+		value, err := decodeXtext(kv[1])
+		if err != nil {
+			c.WriteResponse(501, EnhancedCodeInvalidArguments, "Bad command parameter syntax")
+			return
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			value = ""
+		}
+		switch strings.ToUpper(kv[0]) {
+		case "NAME":
+			xclient.Name = value
+		case "ADDR":
+			xclient.Addr = value
+		case "PORT":
+			if value != "" {
+				if _, err := strconv.ParseUint(value, 10, 16); err != nil {
+					c.WriteResponse(501, EnhancedCodeInvalidArguments, "Bad PORT parameter")
+					return
+				}
+			}
+			xclient.Port = value
+		case "PROTO":
+			xclient.Proto = value
+		case "HELO":
+			xclient.Helo = value
+		case "LOGIN":
+			xclient.Login = value
+		default:
+			c.WriteResponse(501, EnhancedCodeInvalidArguments, "Bad command parameter syntax")
+			return
+		}
+	}
+	if xclient.Addr != "" && xclient.remoteAddr() == nil {
+		c.WriteResponse(501, EnhancedCodeInvalidArguments, "Bad ADDR parameter")
+		return
+	}
+
+	// The XCLIENT command restarts the session, the client has to
+	// introduce itself again unless HELO was given.
+	c.reset(ResetXClient)
+	if session := c.Session(); session != nil {
+		session.Logout()
+		c.SetSession(nil)
+	}
+	c.authenticated = false
+	c.SetAuthenticatedUser("")
+	c.XClient = &xclient
+	c.helo = xclient.Helo
+	// The proxy is trusted to have verified the name
+	if xclient.Name != "" {
+		c.reverseDNS = []string{xclient.Name}
+		c.fcrdns = c.reverseDNS
+	} else if xclient.Addr != "" {
+		c.reverseDNS = nil
+		c.fcrdns = nil
+	}
+
+	c.greet()
+}
+
+// remoteAddr returns the client address announced via XCLIENT or nil if
+// no (valid) address was announced.
+func (x *XClient) remoteAddr() net.Addr {
+	if x.Addr == "" {
+		return nil
+	}
+	ip := net.ParseIP(strings.TrimPrefix(strings.ToUpper(x.Addr), "IPV6:"))
+	if ip == nil {
+		return nil
+	}
+	port, _ := strconv.Atoi(x.Port)
+	return &net.TCPAddr{IP: ip, Port: port}
 }
 
 // READY state -> waiting for MAIL
 func (c *Conn) handleMail(arg string) {
-	if c.helo == "" {
-		c.WriteResponse(502, EnhancedCode{2, 5, 1}, "Please introduce yourself first.")
+	if c.helo == "" && !c.server.lenientAuthOrder {
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, "Please introduce yourself first.")
+		return
+	}
+	if c.tlsRequired() {
+		return
+	}
+	if !c.checkFCrDNS() {
+		return
+	}
+	if !c.checkAvailable() {
 		return
 	}
 
-	if c.Session() == nil {
-		state := c.State()
-		session, err := c.server.backend.AnonymousLogin(&state)
+	if _, lazy := c.server.backend.(EnvelopeValidator); c.Session() == nil && !lazy {
+		session, err := c.newSession()
 		if err != nil {
 			if smtpErr, ok := err.(*SMTPError); ok {
-				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
 			} else {
-				c.WriteResponse(502, EnhancedCode{5, 7, 0}, err.Error())
+				c.WriteResponse(502, EnhancedCodeSecurityError, err.Error())
 			}
 			return
 		}
@@ -294,117 +840,505 @@ func (c *Conn) handleMail(arg string) {
 	}
 
 	if len(arg) < 6 || strings.ToUpper(arg[0:5]) != "FROM:" {
-		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
+		c.WriteResponse(501, EnhancedCodeSyntaxError, "Was expecting MAIL arg syntax of FROM:<address>")
 		return
 	}
-	fromArgs := strings.Split(strings.Trim(arg[5:], " "), " ")
-	if c.server.strict {
-		if !strings.HasPrefix(fromArgs[0], "<") || !strings.HasSuffix(fromArgs[0], ">") {
-			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
-			return
-		}
-	}
-	from := fromArgs[0]
-	if from == "" {
-		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
+	from, fromParams, err := parseReversePath(arg[5:], c.server.strict)
+	if err != nil {
+		c.WriteResponse(501, EnhancedCodeSyntaxError, "Was expecting MAIL arg syntax of FROM:<address>")
 		return
 	}
-	from = strings.Trim(from, "<>")
 
 	// This is where the Conn may put BODY=8BITMIME, but we already
 	// read the DATA as bytes, so it does not effect our processing.
-	if len(fromArgs) > 1 {
-		args, err := parseArgs(fromArgs[1:])
+	binaryMIME, utf8 := false, false
+	opts := &MailOptions{}
+	var params []string
+	for _, param := range fromParams {
+		// SMTPUTF8 is a keyword without value
+		if strings.EqualFold(param, "SMTPUTF8") {
+			if !c.server.smtputf8 {
+				c.WriteResponse(555, EnhancedCodeInvalidArguments, "SMTPUTF8 not supported")
+				return
+			}
+			utf8 = true
+			continue
+		}
+		if strings.EqualFold(param, "REQUIRETLS") && c.server.requireTLSExt {
+			if _, isTLS := c.TLSConnectionState(); !isTLS {
+				c.WriteResponse(530, EnhancedCodeSecurityError, "REQUIRETLS needs an encrypted connection")
+				return
+			}
+			opts.RequireTLS = true
+			continue
+		}
+		params = append(params, param)
+	}
+	if len(params) > 0 {
+		args, err := parseArgs(params)
 		if err != nil {
-			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse MAIL ESMTP parameters")
+			c.WriteResponse(501, EnhancedCodeInvalidArguments, "Unable to parse MAIL ESMTP parameters")
 			return
 		}
+		if c.unknownParams(args, mailParams) {
+			return
+		}
+		opts.Params = args
 
-		if args["SIZE"] != "" {
-			size, err := strconv.ParseInt(args["SIZE"], 10, 32)
+		// The asserted identity is only accepted from trusted clients,
+		// otherwise it is treated as AUTH=<> (RFC 4954 section 5)
+		if auth, ok := args["AUTH"]; ok && auth != "<>" {
+			auth, err := decodeXtext(auth)
 			if err != nil {
-				c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse SIZE as an integer")
+				c.WriteResponse(501, EnhancedCodeInvalidArguments, "Unable to parse AUTH parameter")
+				return
+			}
+			if c.authenticated {
+				opts.Auth = auth
+			}
+		}
+
+		if args["SIZE"] != "" {
+			size, err := strconv.ParseInt(args["SIZE"], 10, 64)
+			if err != nil || size < 0 {
+				c.WriteResponse(501, EnhancedCodeInvalidArguments, "Unable to parse SIZE as an integer")
+				return
+			}
+
+			if max := atomic.LoadInt64(&c.server.maxMessageBytes); max > 0 && size > max {
+				c.WriteResponse(552, EnhancedCodeMessageTooBig, "Max message size exceeded")
 				return
 			}
+			// SIZE=0 is sent by some clients if the size is unknown
+			opts.Size = size
+		}
 
-			if c.server.maxMessageBytes > 0 && int(size) > c.server.maxMessageBytes {
-				c.WriteResponse(552, EnhancedCode{5, 3, 4}, "Max message size exceeded")
+		if strings.EqualFold(args["BODY"], "BINARYMIME") {
+			if !c.server.binaryMIME {
+				c.WriteResponse(555, EnhancedCodeInvalidArguments, "BINARYMIME not supported")
 				return
 			}
+			binaryMIME = true
 		}
 	}
 
-	if err := c.Session().Mail(from); err != nil {
+	rawFrom := from
+	if c.server.mailFromRewrite != nil {
+		state := c.State()
+		rewritten, err := c.server.mailFromRewrite(&state, from)
+		if err != nil {
+			if smtpErr, ok := err.(*SMTPError); ok {
+				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+				return
+			}
+			c.WriteResponse(451, EnhancedCodeTempFailure, err.Error())
+			return
+		}
+		from = rewritten
+	}
+
+	if checker, ok := c.server.backend.(SizeChecker); ok && opts.Size > 0 {
+		state := c.State()
+		if err := checker.CheckSize(&state, from, opts.Size); err != nil {
+			if smtpErr, ok := err.(*SMTPError); ok {
+				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+				return
+			}
+			c.WriteResponse(451, EnhancedCodeTempFailure, err.Error())
+			return
+		}
+	}
+
+	if limiter, ok := c.server.backend.(SendLimiter); ok {
+		state := c.State()
+		if err := limiter.CheckSendLimit(&state, from); err != nil {
+			if smtpErr, ok := err.(*SMTPError); ok {
+				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+				return
+			}
+			c.WriteResponse(451, EnhancedCodeTempFailure, err.Error())
+			return
+		}
+	}
+
+	if validator, lazy := c.lazySession(); lazy {
+		state := c.State()
+		err = validator.ValidateEnvelope(&state, from, nil)
+	} else if session, ok := c.Session().(MailWithOptions); ok {
+		err = session.MailWithOptions(from, opts)
+	} else {
+		err = c.Session().Mail(from)
+	}
+	if err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
-			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
 			return
 		}
-		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
+		c.WriteResponse(451, EnhancedCodeTempFailure, err.Error())
 		return
 	}
 
-	c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Roger, accepting mail from <%v>", from))
+	c.WriteResponse(250, EnhancedCodeOK, fmt.Sprintf("Roger, accepting mail from <%v>", rawFrom))
+	c.locker.Lock()
 	c.fromReceived = true
+	c.rawMailFrom = rawFrom
+	c.mailFrom = from
+	c.locker.Unlock()
+	c.mailOpts = opts
+	c.binaryMIME = binaryMIME
+	c.utf8 = utf8
+}
+
+// checkAvailable refuses the transaction if the backend is overloaded, see
+// AvailabilityChecker. It reports whether the transaction can start.
+func (c *Conn) checkAvailable() bool {
+	checker, ok := c.server.backend.(AvailabilityChecker)
+	if !ok {
+		return true
+	}
+	state := c.State()
+	err := checker.Available(&state)
+	if err == nil {
+		return true
+	}
+
+	smtpErr, ok := err.(*SMTPError)
+	if !ok {
+		smtpErr = &SMTPError{Code: 451, EnhancedCode: EnhancedCodeTempSystemError, Message: err.Error()}
+	}
+	c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+	if smtpErr.Code == 421 {
+		c.Close()
+	}
+	return false
+}
+
+// RawMailFrom returns the sender address of the current transaction as
+// given by the client, before MailFromRewrite was applied.
+func (c *Conn) RawMailFrom() string {
+	return c.rawMailFrom
+}
+
+// lazySession returns the EnvelopeValidator of the backend if the Session
+// has not been created yet.
+func (c *Conn) lazySession() (EnvelopeValidator, bool) {
+	if c.Session() != nil {
+		return nil, false
+	}
+	validator, ok := c.server.backend.(EnvelopeValidator)
+	return validator, ok
+}
+
+// startLazySession creates the Session of a transaction validated by an
+// EnvelopeValidator and passes the envelope to it.
+func (c *Conn) startLazySession() *SMTPError {
+	if _, lazy := c.lazySession(); !lazy {
+		return nil
+	}
+
+	session, err := c.newSession()
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			return smtpErr
+		}
+		return &SMTPError{Code: 502, EnhancedCode: EnhancedCodeSecurityError, Message: err.Error()}
+	}
+	c.SetSession(session)
+
+	if mailSession, ok := session.(MailWithOptions); ok {
+		err = mailSession.MailWithOptions(c.mailFrom, c.mailOpts)
+	} else {
+		err = session.Mail(c.mailFrom)
+	}
+	for _, rcpt := range c.pendingRcpts {
+		if err != nil {
+			break
+		}
+		if rcptSession, ok := session.(RcptWithOptions); ok {
+			err = rcptSession.RcptWithOptions(rcpt.to, rcpt.opts)
+		} else {
+			err = session.Rcpt(rcpt.to)
+		}
+	}
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			return smtpErr
+		}
+		return &SMTPError{Code: 451, EnhancedCode: EnhancedCodeTempFailure, Message: err.Error()}
+	}
+	return nil
+}
+
+// anonymousLogin creates a session for an unauthenticated client. Transient
+// errors are retried as configured with the LoginRetry option.
+func (c *Conn) anonymousLogin() (Session, error) {
+	state := c.State()
+	session, err := c.server.backend.AnonymousLogin(&state)
+	for i := 0; err != nil && i < c.server.loginRetries; i++ {
+		if smtpErr, ok := err.(*SMTPError); ok && !smtpErr.Temporary() {
+			break
+		}
+		time.Sleep(c.server.loginBackoff)
+		state = c.State()
+		session, err = c.server.backend.AnonymousLogin(&state)
+	}
+	return session, err
+}
+
+// newSession creates the session of a transaction if there is none yet. The
+// session of an authenticated client is renewed, see NewSessionPerTransaction.
+func (c *Conn) newSession() (Session, error) {
+	if !c.authenticated {
+		return c.anonymousLogin()
+	}
+	renewer, ok := c.server.backend.(SessionRenewer)
+	if !ok {
+		// The session was cleared with SetSession, the backend can't
+		// create a new one without the credentials
+		return nil, &SMTPError{
+			Code:         530,
+			EnhancedCode: EnhancedCodeSecurityError,
+			Message:      "Session expired, please authenticate again",
+		}
+	}
+	state := c.State()
+	return renewer.RenewSession(&state, c.AuthenticatedUser())
+}
+
+// recipientKey returns the key of a recipient in recipientsmap. LMTP
+// recipients are compared case-insensitively, otherwise only the domain is
+// case-insensitive, the local part may be case-sensitive (RFC 5321 section
+// 2.4).
+func (c *Conn) recipientKey(rcpt string) string {
+	if c.server.lmtp {
+		return strings.ToLower(rcpt)
+	}
+	if i := strings.LastIndexByte(rcpt, '@'); i >= 0 {
+		return rcpt[:i+1] + strings.ToLower(rcpt[i+1:])
+	}
+	return rcpt
+}
+
+// The ESMTP parameters supported by MAIL and RCPT.
+var (
+	mailParams = map[string]bool{"SIZE": true, "BODY": true, "AUTH": true}
+	rcptParams = map[string]bool{"NOTIFY": true, "ORCPT": true}
+)
+
+// unknownParams rejects the command if the RejectUnknownParams option is set
+// and args contains a parameter not in known.
+func (c *Conn) unknownParams(args map[string]string, known map[string]bool) bool {
+	if !c.server.rejectUnknownParams {
+		return false
+	}
+	for k := range args {
+		if !known[k] {
+			c.WriteResponse(555, EnhancedCodeInvalidArguments, "Unsupported parameter")
+			return true
+		}
+	}
+	return false
 }
 
 // MAIL state -> waiting for RCPTs followed by DATA
 func (c *Conn) handleRcpt(arg string) {
 	if !c.fromReceived {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Missing MAIL FROM command.")
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, "Missing MAIL FROM command.")
 		return
 	}
 
 	if (len(arg) < 4) || (strings.ToUpper(arg[0:3]) != "TO:") {
-		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
+		c.WriteResponse(501, EnhancedCodeSyntaxError, "Was expecting RCPT arg syntax of TO:<address>")
 		return
 	}
 
-	// TODO: This trim is probably too forgiving
-	recipient := strings.Trim(arg[3:], "<> ")
+	recipient, toParams, err := parseForwardPath(arg[3:], c.server.strict)
+	if err != nil {
+		c.WriteResponse(501, EnhancedCodeSyntaxError, "Was expecting RCPT arg syntax of TO:<address>")
+		return
+	}
+
+	opts := &RcptOptions{}
+	if len(toParams) > 0 {
+		args, err := parseArgs(toParams)
+		if err != nil {
+			c.WriteResponse(501, EnhancedCodeInvalidArguments, "Unable to parse RCPT ESMTP parameters")
+			return
+		}
+		if c.unknownParams(args, rcptParams) {
+			return
+		}
+		opts.Params = args
+
+		if notify, ok := args["NOTIFY"]; ok {
+			opts.Notify = strings.Split(strings.ToUpper(notify), ",")
+		}
+		if orcpt, ok := args["ORCPT"]; ok {
+			orcpt, err := decodeXtext(orcpt)
+			if err != nil {
+				c.WriteResponse(501, EnhancedCodeInvalidArguments, "Unable to parse ORCPT parameter")
+				return
+			}
+			opts.OriginalRecipient = orcpt
+		}
+	}
+
+	if c.server.dedupRcpts && !c.server.lmtp {
+		if _, ok := c.recipientsmap[c.recipientKey(recipient)]; ok {
+			c.WriteResponse(250, EnhancedCodeOK, fmt.Sprintf("Duplicate recipient <%v> ignored", recipient))
+			return
+		}
+	}
 
-	if c.server.maxRecipients > 0 && len(c.recipients) >= c.server.maxRecipients {
-		c.WriteResponse(552, EnhancedCode{5, 5, 3}, fmt.Sprintf("Maximum limit of %v recipients reached", c.server.maxRecipients))
+	if max := atomic.LoadInt64(&c.server.maxRecipients); max > 0 && int64(len(c.recipients)) >= max {
+		code, enhancedCode := 452, EnhancedCodeTempTooManyRecipients
+		if c.server.permanentRcptLimit {
+			code, enhancedCode = 552, EnhancedCodeTooManyRecipients
+		}
+		c.WriteResponse(code, enhancedCode, fmt.Sprintf("Maximum limit of %v recipients reached", max))
 		return
 	}
 
 	//
 	if c.server.lmtp {
-		if _, ok := c.recipientsmap[strings.ToLower(recipient)]; ok {
-			c.WriteResponse(451, EnhancedCode{4, 0, 0}, fmt.Sprintf("Duplicate RCPT TO:<%s>. Please try again later.", recipient))
+		if _, ok := c.recipientsmap[c.recipientKey(recipient)]; ok {
+			c.WriteResponse(451, EnhancedCodeTempFailure, fmt.Sprintf("Duplicate RCPT TO:<%s>. Please try again later.", recipient))
+			return
+		}
+	}
+
+	if limiter, ok := c.server.backend.(SendLimiter); ok {
+		state := c.State()
+		if err := limiter.CheckRecipientLimit(&state, c.mailFrom, recipient, len(c.recipients)); err != nil {
+			if smtpErr, ok := err.(*SMTPError); ok {
+				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+				return
+			}
+			c.WriteResponse(451, EnhancedCodeTempFailure, err.Error())
 			return
 		}
 	}
 
-	if err := c.Session().Rcpt(recipient); err != nil {
+	if validator, lazy := c.lazySession(); lazy {
+		state := c.State()
+		to := append(append([]string(nil), c.recipients...), strings.ToLower(recipient))
+		if err = validator.ValidateEnvelope(&state, c.mailFrom, to); err == nil {
+			c.pendingRcpts = append(c.pendingRcpts, pendingRcpt{recipient, opts})
+		}
+	} else if session, ok := c.Session().(RcptWithOptions); ok {
+		err = session.RcptWithOptions(recipient, opts)
+	} else {
+		err = c.Session().Rcpt(recipient)
+	}
+	if err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
-			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
 			return
 		}
-		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
+		c.WriteResponse(451, EnhancedCodeTempFailure, err.Error())
 		return
 	}
+	c.locker.Lock()
 	c.recipients = append(c.recipients, strings.ToLower(recipient))
-	c.recipientsmap[strings.ToLower(recipient)] = struct{}{}
-	c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("I'll make sure <%v> gets this", recipient))
+	c.locker.Unlock()
+	c.recipientsmap[c.recipientKey(recipient)] = struct{}{}
+	c.WriteResponse(250, EnhancedCodeOK, fmt.Sprintf("I'll make sure <%v> gets this", recipient))
+}
+
+// handleVrfy looks up the address with the Verifier of the backend. Lookups
+// are only done for authenticated clients to prevent address enumeration.
+func (c *Conn) handleVrfy(arg string) {
+	verifier, ok := c.server.backend.(Verifier)
+	if !ok || !c.authenticated {
+		c.WriteResponse(252, EnhancedCodeProtocolOK, "Cannot VRFY user, but will accept message")
+		return
+	}
+
+	addr := strings.Trim(arg, "<> ")
+	if addr == "" {
+		c.WriteResponse(501, EnhancedCodeInvalidArguments, "Was expecting VRFY arg syntax of <address>")
+		return
+	}
+
+	state := c.State()
+	lines, err := verifier.Verify(&state, addr)
+	c.writeLookupResponse(lines, err, "Cannot VRFY user, but will accept message")
+}
+
+// handleExpn expands the list with the Expander of the backend. Like VRFY,
+// lookups are only done for authenticated clients.
+func (c *Conn) handleExpn(arg string) {
+	expander, ok := c.server.backend.(Expander)
+	if !ok || !c.authenticated {
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, "EXPN command not implemented")
+		return
+	}
+
+	list := strings.TrimSpace(arg)
+	if list == "" {
+		c.WriteResponse(501, EnhancedCodeInvalidArguments, "Was expecting EXPN arg syntax of <list>")
+		return
+	}
+
+	state := c.State()
+	lines, err := expander.Expand(&state, list)
+	c.writeLookupResponse(lines, err, "Cannot EXPN list")
+}
+
+// writeLookupResponse writes the response of a VRFY or EXPN lookup. empty is
+// the message sent if the lookup returned nothing.
+func (c *Conn) writeLookupResponse(lines []string, err error, empty string) {
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+			return
+		}
+		c.WriteResponse(451, EnhancedCodeTempFailure, err.Error())
+		return
+	}
+	if len(lines) == 0 {
+		c.WriteResponse(252, EnhancedCodeProtocolOK, empty)
+		return
+	}
+	c.WriteResponse(250, EnhancedCodeDestinationValid, lines...)
 }
 
 func (c *Conn) handleAuth(arg string) {
-	if c.helo == "" {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Please introduce yourself first.")
+	if c.helo == "" && !c.server.lenientAuthOrder {
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, "Please introduce yourself first.")
+		return
+	}
+	if c.tlsRequired() {
 		return
 	}
 
 	parts := strings.Fields(arg)
 	if len(parts) == 0 {
-		c.WriteResponse(502, EnhancedCode{5, 5, 4}, "Missing parameter")
+		c.WriteResponse(502, EnhancedCodeInvalidArguments, "Missing parameter")
 		return
 	}
 
 	mechanism := strings.ToUpper(parts[0])
 
+	authOK := false
+	c.authAttempt = ""
+	if c.server.onAuthAttempt != nil {
+		defer func() {
+			username := c.authAttempt
+			if authOK {
+				username = c.AuthenticatedUser()
+			}
+			state := c.State()
+			c.server.onAuthAttempt(&state, mechanism, username, authOK)
+		}()
+	}
+
 	// Parse client initial response if there is one
 	var ir []byte
-	if len(parts) > 1 {
+	if len(parts) > 1 && parts[1] == "=" {
+		// Empty initial response (RFC 4954)
+		ir = []byte{}
+	} else if len(parts) > 1 {
 		var err error
 		ir, err = base64.StdEncoding.DecodeString(parts[1])
 		if err != nil {
@@ -412,9 +1346,15 @@ func (c *Conn) handleAuth(arg string) {
 		}
 	}
 
-	newSasl, ok := c.server.auths[mechanism]
+	newSasl, ok := c.server.authMechanism(mechanism)
+	if mechanism == sasl.External && c.externalAllowed() {
+		newSasl, ok = newExternalServer, true
+	}
+	if mechanism == cramMD5 && c.cramMD5Allowed() {
+		newSasl, ok = newCramMD5Server, true
+	}
 	if !ok {
-		c.WriteResponse(504, EnhancedCode{5, 7, 4}, "Unsupported authentication mechanism")
+		c.WriteResponse(504, EnhancedCodeUnsupportedAuth, "Unsupported authentication mechanism")
 		return
 	}
 
@@ -425,10 +1365,10 @@ func (c *Conn) handleAuth(arg string) {
 		challenge, done, err := sasl.Next(response)
 		if err != nil {
 			if smtpErr, ok := err.(*SMTPError); ok {
-				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+				c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
 				return
 			}
-			c.WriteResponse(454, EnhancedCode{4, 7, 0}, err.Error())
+			c.WriteResponse(454, EnhancedCodeTempSecurityError, err.Error())
 			return
 		}
 
@@ -449,111 +1389,293 @@ func (c *Conn) handleAuth(arg string) {
 
 		response, err = base64.StdEncoding.DecodeString(encoded)
 		if err != nil {
-			c.WriteResponse(454, EnhancedCode{4, 7, 0}, "Invalid base64 data")
+			c.WriteResponse(454, EnhancedCodeTempSecurityError, "Invalid base64 data")
 			return
 		}
 	}
 
 	if c.Session() != nil {
-		c.WriteResponse(235, EnhancedCode{2, 0, 0}, "Authentication succeeded")
+		c.authenticated = true
+		authOK = true
+		c.WriteResponse(235, EnhancedCodeOK, "Authentication succeeded")
 	}
 }
 
 func (c *Conn) handleStartTLS() {
 	if _, isTLS := c.TLSConnectionState(); isTLS {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Already running in TLS")
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, "Already running in TLS")
 		return
 	}
 
 	if c.server.tlsconfig == nil {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "TLS not supported")
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, "TLS not supported")
 		return
 	}
 
-	c.WriteResponse(220, EnhancedCode{2, 0, 0}, "Ready to start TLS")
+	// Discard any plaintext pipelined after STARTTLS, it must not be
+	// processed as if it was received over TLS (CVE-2011-0411).
+	c.text.R.Discard(c.text.R.Buffered())
+
+	c.WriteResponse(220, EnhancedCodeOK, "Ready to start TLS")
+
+	tlsConfig := c.server.tlsconfig
+	if c.server.tlsClientAuth != nil {
+		state := c.State()
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ClientAuth = c.server.tlsClientAuth(&state)
+	}
 
 	// Upgrade to TLS
 	var tlsConn *tls.Conn
-	tlsConn = tls.Server(c.conn, c.server.tlsconfig)
+	tlsConn = tls.Server(c.conn, tlsConfig)
 
 	if err := tlsConn.Handshake(); err != nil {
-		c.WriteResponse(550, EnhancedCode{5, 0, 0}, "Handshake error")
+		c.server.errorLog.Printf("TLS handshake error for %s: %v", c.conn.RemoteAddr(), err)
+		c.Close()
+		return
 	}
 
 	c.conn = tlsConn
+	c.startTLS = true
 	c.init()
 
+	if !c.checkTLS() {
+		return
+	}
+
 	// Reset envelope as a new EHLO/HELO is required after STARTTLS
-	c.reset()
+	c.reset(ResetTLS)
+}
+
+// discardPipelinedData discards the message of a rejected DATA command if the
+// client already sent it without waiting for the 354 response. DATA must be
+// the last command of a pipelined group (RFC 2920), so any input buffered
+// after it belongs to the message and must not be read as commands.
+//
+// Only data which already arrived with the DATA command is discarded. Data
+// arriving later is still read as commands, mostly rejected as unknown. A
+// client following RFC 2920 waits for the response to DATA before sending
+// the message, so this only affects clients which don't.
+func (c *Conn) discardPipelinedData() {
+	if c.text.R.Buffered() == 0 {
+		return
+	}
+	r := newDataReader(c)
+	if r.drain() == errDrainLimit {
+		c.Close()
+		return
+	}
+	c.conn.SetReadDeadline(time.Time{})
+}
+
+// checkTLS runs the PostHandshakeTLSCheck on the negotiated TLS connection,
+// the connection is closed if the check fails.
+func (c *Conn) checkTLS() bool {
+	tlsState, isTLS := c.TLSConnectionState()
+	if !isTLS || c.server.postHandshakeTLSCheck == nil {
+		return true
+	}
+	if err := c.server.postHandshakeTLSCheck(tlsState); err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+		} else {
+			c.WriteResponse(550, EnhancedCodeSecurityError, err.Error())
+		}
+		c.Close()
+		return false
+	}
+	return true
 }
 
 // DATA
 func (c *Conn) handleData(arg string) {
 	if arg != "" {
-		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "DATA command should not have any arguments")
+		c.WriteResponse(501, EnhancedCodeInvalidArguments, "DATA command should not have any arguments")
 		return
 	}
 
 	if !c.fromReceived || len(c.recipients) == 0 {
-		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "Missing RCPT TO command.")
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, "Missing RCPT TO command.")
+		c.discardPipelinedData()
+		return
+	}
+	if c.binaryMIME {
+		c.WriteResponse(503, EnhancedCodeInvalidCommand, "BINARYMIME messages must be sent with BDAT")
+		c.discardPipelinedData()
+		return
+	}
+	if err := c.startLazySession(); err != nil {
+		c.WriteResponse(err.Code, err.EnhancedCode, err.responseMessage())
+		c.discardPipelinedData()
+		c.reset(ResetTransactionEnd)
 		return
 	}
 
 	// We have recipients, go to accept data
-	c.WriteResponse(354, EnhancedCode{2, 0, 0}, "Go ahead. End your data with <CR><LF>.<CR><LF>")
+	c.WriteResponse(354, EnhancedCodeOK, c.server.messages.Data)
+
+	start := time.Now()
+	c.transactionStart("DATA")
 
+	r := newDataReader(c)
+	dataContext := c.newDataContext(r)
+	err := c.Session().Data(dataContext.r, dataContext)
+	// Make sure all the data has been consumed
+	drainErr := r.drain()
+	if r.expired {
+		c.WriteResponse(ErrDataDurationExceeded.Code, ErrDataDurationExceeded.EnhancedCode, ErrDataDurationExceeded.Message)
+		c.transactionEnd(start, false, r.bytes)
+		c.Close()
+		return
+	}
+	if c.server.maxDataDuration > 0 {
+		// Clear the deadline of the DATA phase
+		c.conn.SetReadDeadline(time.Time{})
+	}
+	if drainErr == errDrainLimit {
+		c.WriteResponse(ErrDataTooLarge.Code, ErrDataTooLarge.EnhancedCode, ErrDataTooLarge.Message)
+		c.transactionEnd(start, false, r.bytes)
+		c.Close()
+		return
+	} else if err == nil && drainErr != nil {
+		// The backend accepted a message it didn't read completely
+		err = drainErr
+	}
+
+	accepted := c.writeDataResponse(dataContext, err)
+	c.recipientResults(dataContext)
+	c.transactionEnd(start, accepted, r.bytes)
+	c.reset(ResetTransactionEnd)
+}
+
+// transactionStart calls the OnTransactionStart hook, if any.
+func (c *Conn) transactionStart(cmd string) {
+	if c.server.onTransactionStart != nil {
+		state := c.State()
+		c.server.onTransactionStart(&state, cmd)
+	}
+}
+
+// recipientResults calls the OnRecipientResults hook, if any, with the
+// results recorded by the backend.
+func (c *Conn) recipientResults(dataContext *dataContext) {
+	dataContext.resultsLock.Lock()
+	results := dataContext.results
+	dataContext.resultsLock.Unlock()
+
+	if c.server.onRecipientResults != nil && len(results) > 0 {
+		state := c.State()
+		c.server.onRecipientResults(&state, results)
+	}
+}
+
+// transactionEnd calls the OnTransactionEnd hook, if any. An accepted
+// message resets the count of commands without progress.
+func (c *Conn) transactionEnd(start time.Time, accepted bool, bytes int64) {
+	if accepted {
+		c.nbrNoops = 0
+	}
+	if c.server.onTransactionEnd != nil {
+		state := c.State()
+		c.server.onTransactionEnd(&state, accepted, int(bytes), time.Since(start))
+	}
+}
+
+// newDataContext returns the DataContext of the current transaction for the
+// message r.
+func (c *Conn) newDataContext(r io.Reader) *dataContext {
+	dataContext := newdataContext(c.XForward)
+	dataContext.helo = c.helo
+	dataContext.state = c.State()
+	dataContext.protocol = c.protocol()
+	dataContext.domain = c.domain()
+	dataContext.recipients = c.recipients
+	dataContext.r = &countingReader{r: r}
+	dataContext.binaryMIME = c.binaryMIME
+	dataContext.requireTLS = c.mailOpts != nil && c.mailOpts.RequireTLS
+	dataContext.conn = c.conn
+	dataContext.writeTimeout = c.server.writeTimeout
+	return dataContext
+}
+
+// writeDataResponse writes the response to the end of a message, err is the
+// error returned by Session.Data. LMTP servers write the status of every
+// recipient. It reports whether the message was accepted, for LMTP whether
+// it was accepted for at least one recipient.
+func (c *Conn) writeDataResponse(dataContext *dataContext, err error) bool {
 	var (
 		code         int
 		enhancedCode EnhancedCode
 		msg          string
 	)
-	r := newDataReader(c)
-	dataContext := newdataContext(c.XForward)
-	dataContext.helo = c.helo
-	err := c.Session().Data(r, dataContext)
-	io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
 	if err != nil {
 		if smtperr, ok := err.(*SMTPError); ok {
+			c.server.errorLog.Printf("Message from %v rejected after %d bytes: %v", dataContext.state.RemoteAddr, dataContext.BytesRead(), err)
 			code = smtperr.Code
 			enhancedCode = smtperr.EnhancedCode
-			msg = smtperr.Message
+			msg = smtperr.responseMessage()
 		} else {
 			code = 554
-			enhancedCode = EnhancedCode{5, 0, 0}
+			enhancedCode = EnhancedCodePermFailure
 			msg = "Error: transaction failed, blame it on the weather: " + err.Error()
 		}
 	} else {
 		if dataContext.smtpresponse == nil {
 			code = 250
-			enhancedCode = EnhancedCode{2, 0, 0}
+			enhancedCode = EnhancedCodeOK
 			msg = "OK: queued"
+		} else if dataContext.responseLines != nil && !c.server.lmtp {
+			c.WriteResponse(dataContext.smtpresponse.Code, dataContext.smtpresponse.EnhancedCode, dataContext.responseLines...)
+			return dataContext.smtpresponse.Code/100 == 2
 		} else {
-			code, enhancedCode, msg = dataContext.smtpresponse.Code, dataContext.smtpresponse.EnhancedCode, dataContext.smtpresponse.Message
+			code, enhancedCode, msg = dataContext.smtpresponse.Code, dataContext.smtpresponse.EnhancedCode, dataContext.smtpresponse.responseMessage()
 		}
 	}
 
 	if c.server.lmtp {
+		accepted := false
 		for _, rcpt := range c.recipients {
 			var status *SMTPError
-			rcptStatus := dataContext.rcptStatus[rcpt]
+			rcptStatus, ok := dataContext.rcptStatus[rcpt]
+			if !ok {
+				// The backend never started the delivery, e.g. because
+				// Data failed
+				status = &SMTPError{
+					Code:         451,
+					EnhancedCode: EnhancedCodeTempFailure,
+					Message:      "Error: delivery not started",
+				}
+				if err != nil {
+					status = &SMTPError{Code: code, EnhancedCode: enhancedCode, Message: msg}
+				}
+				c.WriteResponse(status.Code, status.EnhancedCode, "<"+rcpt+"> "+status.responseMessage())
+				continue
+			}
+			ctx, cancel := rcptStatus.ctx, context.CancelFunc(func() {})
+			if _, ok := ctx.Deadline(); !ok && c.server.lmtpDeliveryTimeout > 0 {
+				ctx, cancel = context.WithTimeout(ctx, c.server.lmtpDeliveryTimeout)
+			}
 			select {
-			case <-rcptStatus.ctx.Done():
-				c.Server().errorLog.Printf("Context Error: %s - tempfailing", rcptStatus.ctx.Err())
+			case <-ctx.Done():
+				c.Server().errorLog.Printf("Context Error: %s - tempfailing", ctx.Err())
 				status = &SMTPError{
 					Code:         420,
-					EnhancedCode: EnhancedCode{4, 4, 7},
+					EnhancedCode: EnhancedCodeDeliveryExpired,
 					Message:      "Error: timeout reached",
 				}
 			case status = <-rcptStatus.ch:
 			}
-			c.WriteResponse(status.Code, status.EnhancedCode, "<"+rcpt+"> "+status.Message)
+			cancel()
+			c.WriteResponse(status.Code, status.EnhancedCode, "<"+rcpt+"> "+status.responseMessage())
+			if status.Code/100 == 2 {
+				accepted = true
+			}
 		}
-
-	} else {
-		c.WriteResponse(code, enhancedCode, msg)
+		return accepted
 	}
 
-	c.reset()
+	c.WriteResponse(code, enhancedCode, msg)
+	return code/100 == 2
 }
 
 type rcptStatus struct {
@@ -566,6 +1688,27 @@ type dataContext struct {
 	xforwarded   *XForward
 	helo         string
 	smtpresponse *SMTPError
+	// the lines of a multi-line smtpresponse set by WriteResponse
+	responseLines []string
+	binaryMIME    bool
+	requireTLS    bool
+
+	// the results recorded by SetRecipientResult
+	resultsLock sync.Mutex
+	results     map[string]*SMTPError
+
+	// the message passed to Session.Data, also used by MultiDeliver
+	r *countingReader
+
+	// used by Heartbeat
+	conn         net.Conn
+	writeTimeout time.Duration
+
+	// used for the Received header
+	state      ConnectionState
+	protocol   string
+	domain     string
+	recipients []string
 }
 
 func newdataContext(xforwarded *XForward) *dataContext {
@@ -575,13 +1718,39 @@ func newdataContext(xforwarded *XForward) *dataContext {
 	}
 }
 
+func (s *dataContext) Heartbeat() {
+	if s.writeTimeout != 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+}
+
 func (s *dataContext) SetSMTPResponse(response *SMTPError) {
 	s.smtpresponse = response
+	s.responseLines = nil
+}
+
+func (s *dataContext) WriteResponse(code int, enhCode EnhancedCode, lines ...string) {
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	s.smtpresponse = &SMTPError{Code: code, EnhancedCode: enhCode, Message: lines[len(lines)-1]}
+	s.responseLines = lines
 }
 
 func (s *dataContext) SetStatus(rcpt string, status *SMTPError) {
 	rcpt = strings.ToLower(rcpt)
-	s.rcptStatus[rcpt].ch <- status
+	if rcptStatus, ok := s.rcptStatus[rcpt]; ok {
+		rcptStatus.ch <- status
+	}
+}
+
+func (s *dataContext) SetRecipientResult(rcpt string, status *SMTPError) {
+	s.resultsLock.Lock()
+	defer s.resultsLock.Unlock()
+	if s.results == nil {
+		s.results = make(map[string]*SMTPError)
+	}
+	s.results[strings.ToLower(rcpt)] = status
 }
 
 func (s *dataContext) StartDelivery(ctx context.Context, rcpt string) {
@@ -592,6 +1761,69 @@ func (s *dataContext) StartDelivery(ctx context.Context, rcpt string) {
 	}
 }
 
+// multiDeliverMaxMem is the size up to which MultiDeliver keeps messages in
+// memory, larger messages are spooled to a temporary file.
+const multiDeliverMaxMem = 1024 * 1024
+
+func (s *dataContext) MultiDeliver(deliver func(rcpt string, r io.Reader) *SMTPError) error {
+	rs, cleanup, err := spool(s.r, multiDeliverMaxMem)
+	if err != nil {
+		status, ok := err.(*SMTPError)
+		if !ok {
+			status = &SMTPError{
+				Code:         451,
+				EnhancedCode: EnhancedCodeTempSystemError,
+				Message:      "Error: unable to spool message",
+			}
+		}
+		for _, rcpt := range s.recipients {
+			s.StartDelivery(context.Background(), rcpt)
+			s.SetStatus(rcpt, status)
+		}
+		return err
+	}
+	defer cleanup()
+
+	for _, rcpt := range s.recipients {
+		s.StartDelivery(context.Background(), rcpt)
+		var status *SMTPError
+		if _, err := rs.Seek(0, io.SeekStart); err != nil {
+			status = &SMTPError{
+				Code:         451,
+				EnhancedCode: EnhancedCodeTempSystemError,
+				Message:      "Error: unable to read spooled message",
+			}
+		} else {
+			status = deliver(rcpt, rs)
+		}
+		if status == nil {
+			status = &SMTPError{
+				Code:         250,
+				EnhancedCode: EnhancedCodeOK,
+				Message:      "OK: delivered",
+			}
+		}
+		s.SetStatus(rcpt, status)
+	}
+	return nil
+}
+
+func (s *dataContext) BytesRead() int64 {
+	return s.r.n
+}
+
+func (s *dataContext) BinaryMIME() bool {
+	return s.binaryMIME
+}
+
+func (s *dataContext) RequireTLS() bool {
+	return s.requireTLS
+}
+
+func (s *dataContext) ParseMessage() (*mail.Message, error) {
+	return mail.ReadMessage(s.r)
+}
+
 func (s *dataContext) GetXForward() XForward {
 	return *s.xforwarded
 }
@@ -601,12 +1833,58 @@ func (s *dataContext) GetHelo() string {
 }
 
 func (c *Conn) Reject() {
-	c.WriteResponse(421, EnhancedCode{4, 4, 5}, "Too busy. Try again later.")
+	c.WriteResponse(421, EnhancedCodeCongestion, c.server.messages.Reject)
 	c.Close()
 }
 
+// checkConnection asks the backend whether the client may be greeted, see
+// ConnectionChecker. The rejection is sent instead of the greeting.
+func (c *Conn) checkConnection() bool {
+	checker, ok := c.server.backend.(ConnectionChecker)
+	if !ok {
+		return true
+	}
+	state := c.State()
+	err := checker.CheckConnection(&state)
+	if err == nil {
+		return true
+	}
+
+	smtpErr, ok := err.(*SMTPError)
+	if !ok {
+		smtpErr = &SMTPError{Code: 421, EnhancedCode: EnhancedCodeTempSystemError, Message: err.Error()}
+	}
+	c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+	return false
+}
+
 func (c *Conn) greet() {
-	c.WriteResponse(220, NoEnhancedCode, fmt.Sprintf("%v ESMTP Service Ready", c.server.domain))
+	greeting := c.server.messages.Greeting
+	switch {
+	case greeting == "" && c.server.identity != "":
+		greeting = fmt.Sprintf("ESMTP %v Service Ready", c.server.identity)
+	case greeting == "":
+		greeting = "ESMTP Service Ready"
+	case c.server.identity != "":
+		greeting += " " + c.server.identity
+	}
+	c.WriteResponse(220, NoEnhancedCode, fmt.Sprintf("%v %v", c.domain(), greeting))
+}
+
+// waitGreetingDelay waits for the greeting delay and reports whether the
+// client stayed silent meanwhile. Early talkers are rejected.
+func (c *Conn) waitGreetingDelay() bool {
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.server.greetingDelay)); err != nil {
+		return false
+	}
+	_, err := c.text.R.Peek(1)
+	c.conn.SetReadDeadline(time.Time{})
+	if err == nil {
+		c.WriteResponse(554, EnhancedCodeSecurityError, "Protocol violation: data sent before greeting")
+		return false
+	}
+	neterr, ok := err.(net.Error)
+	return ok && neterr.Timeout()
 }
 
 func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
@@ -615,16 +1893,19 @@ func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
 		c.conn.SetWriteDeadline(time.Now().Add(c.server.writeTimeout))
 	}
 
-	// All responses must include an enhanced code, if it is missing - use
-	// a generic code X.0.0.
-	if enhCode == EnhancedCodeNotSet {
-		cat := code / 100
-		switch cat {
-		case 2, 4, 5:
+	// All 2xx, 4xx and 5xx responses must include an enhanced code, if it is
+	// missing - use a generic code X.0.0. Other responses, e.g. the 334 AUTH
+	// challenge or the 354 DATA prompt, never have one (RFC 2034).
+	switch cat := code / 100; cat {
+	case 2, 4, 5:
+		if enhCode == EnhancedCodeNotSet {
 			enhCode = EnhancedCode{cat, 0, 0}
-		default:
-			enhCode = NoEnhancedCode
 		}
+	default:
+		enhCode = NoEnhancedCode
+	}
+	if c.server.noEnhancedCodes {
+		enhCode = NoEnhancedCode
 	}
 
 	for i := 0; i < len(text)-1; i++ {
@@ -648,14 +1929,47 @@ func (c *Conn) ReadLine() (string, error) {
 	return c.text.ReadLine()
 }
 
-func (c *Conn) reset() {
+// readCommand waits up to the IdleTimeout for the next command and reads it.
+func (c *Conn) readCommand() (string, error) {
+	if c.server.idleTimeout != 0 {
+		c.text.closeDot()
+		if c.text.R.Buffered() == 0 {
+			if err := c.conn.SetReadDeadline(time.Now().Add(c.server.idleTimeout)); err != nil {
+				return "", err
+			}
+			if _, err := c.text.R.Peek(1); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return c.ReadLine()
+}
+
+func (c *Conn) reset(reason ResetReason) {
+	c.abortBdat()
+
 	c.locker.Lock()
 	defer c.locker.Unlock()
 
-	if c.session != nil {
+	if session, ok := c.session.(ResetWithReason); ok {
+		session.ResetWithReason(reason)
+	} else if c.session != nil {
 		c.session.Reset()
 	}
+	if c.session != nil && c.server.renewSessions {
+		if _, renewable := c.server.backend.(SessionRenewer); !c.authenticated || renewable {
+			c.session.Logout()
+			c.session = nil
+		}
+	}
 	c.fromReceived = false
+	c.rawMailFrom = ""
+	c.mailFrom = ""
+	c.mailOpts = nil
+	c.pendingRcpts = nil
+	c.binaryMIME = false
+	c.utf8 = false
 	c.recipients = nil
 	c.recipientsmap = make(map[string]struct{})
 	c.XForward = new(XForward)
@@ -1,7 +1,13 @@
 package smtp
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
 )
 
 type EnhancedCode [3]int
@@ -11,6 +17,9 @@ type SMTPError struct {
 	Code         int
 	EnhancedCode EnhancedCode
 	Message      string
+	// RetryAfter is an advisory retry interval for temporary errors. If set,
+	// it is appended to the response text, e.g. "try again in 300s".
+	RetryAfter time.Duration
 }
 
 // NoEnhancedCode is used to indicate that enhanced error code should not be
@@ -26,37 +35,156 @@ var NoEnhancedCode = EnhancedCode{-1, -1, -1}
 // be used (X is derived from error code).
 var EnhancedCodeNotSet = EnhancedCode{0, 0, 0}
 
+// Enhanced status codes (RFC 3463) used by the server. Backends should use
+// them to return consistent codes.
+var (
+	// Generic success, temporary and permanent failure
+	EnhancedCodeOK          = EnhancedCode{2, 0, 0}
+	EnhancedCodeTempFailure = EnhancedCode{4, 0, 0}
+	EnhancedCodePermFailure = EnhancedCode{5, 0, 0}
+
+	// Addressing status
+	EnhancedCodeAddressOK          = EnhancedCode{2, 1, 0}
+	EnhancedCodeDestinationValid   = EnhancedCode{2, 1, 5}
+	EnhancedCodeMailboxUnavailable = EnhancedCode{5, 1, 1}
+
+	// System and message status
+	EnhancedCodeTempSystemError = EnhancedCode{4, 3, 0}
+	EnhancedCodeSystemFull      = EnhancedCode{4, 3, 1}
+	EnhancedCodeMessageTooBig   = EnhancedCode{5, 3, 4}
+	EnhancedCodeMediaError      = EnhancedCode{5, 6, 0}
+
+	// Network and routing status
+	EnhancedCodeNetworkError    = EnhancedCode{4, 4, 0}
+	EnhancedCodeBadConnection   = EnhancedCode{4, 4, 2}
+	EnhancedCodeCongestion      = EnhancedCode{4, 4, 5}
+	EnhancedCodeDeliveryExpired = EnhancedCode{4, 4, 7}
+
+	// Protocol status
+	EnhancedCodeProtocolOK            = EnhancedCode{2, 5, 0}
+	EnhancedCodeTempTooManyRecipients = EnhancedCode{4, 5, 3}
+	EnhancedCodeInvalidCommand        = EnhancedCode{5, 5, 1}
+	EnhancedCodeSyntaxError           = EnhancedCode{5, 5, 2}
+	EnhancedCodeTooManyRecipients     = EnhancedCode{5, 5, 3}
+	EnhancedCodeInvalidArguments      = EnhancedCode{5, 5, 4}
+
+	// Security status
+	EnhancedCodeTempSecurityError  = EnhancedCode{4, 7, 0}
+	EnhancedCodeSecurityError      = EnhancedCode{5, 7, 0}
+	EnhancedCodeNotAuthorized      = EnhancedCode{5, 7, 1}
+	EnhancedCodeUnsupportedAuth    = EnhancedCode{5, 7, 4}
+	EnhancedCodeInvalidCredentials = EnhancedCode{5, 7, 8}
+	EnhancedCodeReverseDNSFailed   = EnhancedCode{5, 7, 25}
+)
+
 func (err *SMTPError) Error() string {
 	return err.Message
 }
 
+// responseMessage returns the message text of the response, including the
+// retry hint.
+func (err *SMTPError) responseMessage() string {
+	if err.RetryAfter <= 0 {
+		return err.Message
+	}
+	secs := int64((err.RetryAfter + time.Second - 1) / time.Second)
+	return fmt.Sprintf("%s, try again in %ds", err.Message, secs)
+}
+
+// Temporary reports whether the error is a transient (4xx) error.
+func (err *SMTPError) Temporary() bool {
+	return err.Code/100 == 4
+}
+
 var ErrDataTooLarge = &SMTPError{
 	Code:         552,
-	EnhancedCode: EnhancedCode{5, 3, 4},
+	EnhancedCode: EnhancedCodeMessageTooBig,
 	Message:      "Maximum message size exceeded",
 }
 
+// ErrInsufficientStorage can be returned by a SizeChecker if the message
+// can't be stored for now, but may be accepted later.
+var ErrInsufficientStorage = &SMTPError{
+	Code:         452,
+	EnhancedCode: EnhancedCodeSystemFull,
+	Message:      "Insufficient system storage",
+}
+
+var ErrDataLineTooLong = &SMTPError{
+	Code:         554,
+	EnhancedCode: EnhancedCodeMediaError,
+	Message:      "Maximum line length exceeded",
+}
+
+var ErrDataHeaderTooLarge = &SMTPError{
+	Code:         552,
+	EnhancedCode: EnhancedCodeMediaError,
+	Message:      "Message header too large",
+}
+
+var ErrDataBareLF = &SMTPError{
+	Code:         554,
+	EnhancedCode: EnhancedCodeMediaError,
+	Message:      "Bare LF line endings are not allowed",
+}
+
+var ErrDataDurationExceeded = &SMTPError{
+	Code:         451,
+	EnhancedCode: EnhancedCodeBadConnection,
+	Message:      "Maximum DATA duration exceeded",
+}
+
 type dataReader struct {
-	r io.Reader
+	r   io.Reader
+	dot *dotReader
+
+	conn     net.Conn
+	timeout  time.Duration // Read deadline for each read, 0 means unset
+	deadline time.Time     // Deadline of the whole DATA phase, zero means unset
+	expired  bool          // Whether the deadline was exceeded
+	bytes    int64         // Number of bytes read
 
 	limited bool
+	max     int64 // Maximum message size
 	n       int64 // Maximum bytes remaining
+
+	maxLineLength int   // Maximum length of a line, 0 means unlimited
+	lineLength    int   // Length of the current line
+	rejectBareLF  bool  // Whether lines terminated by a bare LF are rejected
+	err           error // Sticky line length, header size or bare LF error
+
+	header headerCounter
 }
 
-func newDataReader(c *Conn) io.Reader {
+func newDataReader(c *Conn) *dataReader {
+	dot := c.text.dotReader()
 	dr := &dataReader{
-		r: c.text.DotReader2(),
+		r:             dot,
+		dot:           dot,
+		conn:          c.conn,
+		timeout:       c.server.dataTimeout,
+		maxLineLength: c.server.maxDataLineLength,
+		rejectBareLF:  c.server.rejectBareLF,
+		header:        headerCounter{max: c.server.maxHeaderBytes},
+	}
+
+	if c.server.maxDataDuration > 0 {
+		dr.deadline = time.Now().Add(c.server.maxDataDuration)
 	}
 
-	if c.server.maxMessageBytes > 0 {
+	if max := atomic.LoadInt64(&c.server.maxMessageBytes); max > 0 {
 		dr.limited = true
-		dr.n = int64(c.server.maxMessageBytes)
+		dr.max = max
+		dr.n = dr.max
 	}
 
 	return dr
 }
 
 func (r *dataReader) Read(b []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
 	if r.limited {
 		if r.n <= 0 {
 			return 0, ErrDataTooLarge
@@ -66,10 +194,142 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 		}
 	}
 
+	if err := setMessageDeadline(r.conn, r.timeout, r.deadline); err != nil {
+		return 0, err
+	}
+
 	n, err = r.r.Read(b)
+	r.bytes += int64(n)
+	if deadlineExceeded(err, r.deadline) {
+		r.expired = true
+		r.err = ErrDataDurationExceeded
+		return n, r.err
+	}
+	if r.rejectBareLF && r.dot.bareLF {
+		r.err = ErrDataBareLF
+		return n, r.err
+	}
+
+	if r.maxLineLength > 0 {
+		for i, c := range b[:n] {
+			switch c {
+			case '\n':
+				r.lineLength = 0
+			case '\r':
+			default:
+				r.lineLength++
+				if r.lineLength > r.maxLineLength {
+					n, r.err = i, ErrDataLineTooLong
+					err = r.err
+				}
+			}
+			if r.err != nil {
+				break
+			}
+		}
+	}
+
+	if i, ok := r.header.count(b[:n]); !ok {
+		n, r.err = i, ErrDataHeaderTooLarge
+		err = r.err
+	}
 
 	if r.limited {
 		r.n -= int64(n)
 	}
 	return
 }
+
+// setMessageDeadline sets the read deadline of conn for the next read of
+// message data: timeout from now, but not after deadline. Nothing is set if
+// both are unset, the deadline of the command applies then.
+func setMessageDeadline(conn net.Conn, timeout time.Duration, deadline time.Time) error {
+	if timeout == 0 && deadline.IsZero() {
+		return nil
+	}
+	if timeout != 0 {
+		if d := time.Now().Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return conn.SetReadDeadline(deadline)
+}
+
+// deadlineExceeded reports whether err is a timeout caused by deadline.
+func deadlineExceeded(err error, deadline time.Time) bool {
+	neterr, ok := err.(net.Error)
+	return ok && neterr.Timeout() && !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// headerCounter counts the bytes of the header section of a message, up to
+// the first empty line.
+type headerCounter struct {
+	max  int64 // Maximum size of the header section, 0 means unlimited
+	n    int64 // Size of the header section read so far
+	line int   // Length of the current header line
+	done bool  // Whether the empty line ending the header was read
+}
+
+// count counts the header bytes in b. If the header exceeds max, it returns
+// the number of bytes within the limit and false.
+func (h *headerCounter) count(b []byte) (int, bool) {
+	if h.max <= 0 || h.done {
+		return len(b), true
+	}
+	for i, c := range b {
+		if h.n >= h.max {
+			return i, false
+		}
+		h.n++
+		switch c {
+		case '\n':
+			if h.line == 0 {
+				h.done = true
+				return len(b), true
+			}
+			h.line = 0
+		case '\r':
+		default:
+			h.line++
+		}
+	}
+	return len(b), true
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// errDrainLimit is returned by drain if the message is too large to be
+// discarded.
+var errDrainLimit = errors.New("smtp: message too large to discard")
+
+// drain discards the rest of the message, so that the next command can be
+// read even if the backend didn't consume the whole message. It returns the
+// error hit while reading the message, e.g. ErrDataTooLarge. Once the size
+// limit was hit, at most another maxMessageBytes are discarded before
+// errDrainLimit is returned. Read errors of the connection are ignored, the
+// next command read fails anyway.
+func (r *dataReader) drain() error {
+	_, err := io.Copy(ioutil.Discard, r)
+	if err != ErrDataTooLarge && err != ErrDataLineTooLong && err != ErrDataHeaderTooLarge && err != ErrDataBareLF {
+		return nil
+	}
+
+	if !r.limited {
+		io.Copy(ioutil.Discard, r.r)
+		return err
+	}
+	if n, copyErr := io.CopyN(ioutil.Discard, r.r, r.max); copyErr == nil && n == r.max {
+		return errDrainLimit
+	}
+	return err
+}
@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseEtrnNode parses the argument of the ETRN command: a domain, "@domain"
+// or "#queue".
+func parseEtrnNode(arg string) (string, bool) {
+	node := strings.TrimSpace(arg)
+	name := strings.TrimLeft(node, "@#")
+	if name == "" || len(node)-len(name) > 1 || strings.ContainsAny(node, " \t") {
+		return "", false
+	}
+	if node[0] != '#' {
+		node = strings.ToLower(node)
+	}
+	return node, true
+}
+
+// ETRN -> start a queue run for a node (RFC 1985)
+func (c *Conn) handleEtrn(arg string) {
+	be, ok := c.server.backend.(ETRNBackend)
+	if !ok {
+		c.WriteResponse(502, EnhancedCodeInvalidCommand, "ETRN command not implemented")
+		return
+	}
+	if c.fromReceived {
+		c.WriteResponse(503, EnhancedCodeInvalidCommand, "ETRN not allowed during a mail transaction")
+		return
+	}
+	node, ok := parseEtrnNode(arg)
+	if !ok {
+		c.WriteResponse(501, EnhancedCodeInvalidArguments, "Was expecting ETRN arg syntax of [@|#]node")
+		return
+	}
+
+	state := c.State()
+	if err := be.ETRN(&state, node); err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.responseMessage())
+			return
+		}
+		c.WriteResponse(458, EnhancedCodeTempFailure, fmt.Sprintf("Unable to queue messages for node %v", node))
+		return
+	}
+
+	c.WriteResponse(250, EnhancedCodeOK, fmt.Sprintf("OK, queuing for node %v started", node))
+}
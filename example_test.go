@@ -61,7 +61,7 @@ var (
 	recipients = []string{"foo@example.com"}
 )
 
-func ExampleSendMail_PlainAuth() {
+func ExampleSendMail_plainAuth() {
 	// hostname is used by PlainAuth to validate the TLS certificate.
 	hostname := "mail.example.com"
 	auth := sasl.NewPlainClient("", "user@example.com", "password")
@@ -129,7 +129,7 @@ func ExampleNew() {
 		smtp.DisableAuth(),
 	).ListenAndServe()
 
-	if err != nil {
+	if err != nil && err != smtp.ErrServerClosed {
 		log.Fatal(err)
 	}
 }
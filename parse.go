@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -12,28 +13,29 @@ func parseCmd(line string) (cmd string, arg string, err error) {
 	switch {
 	case strings.HasPrefix(strings.ToUpper(line), "STARTTLS"):
 		return "STARTTLS", "", nil
-	case strings.HasPrefix(strings.ToUpper(line), "XFORWARD"):
-		return "XFORWARD", strings.Trim(line[9:], " \n\r"), nil
 	case l == 0:
 		return "", "", nil
 	case l < 4:
 		return "", "", fmt.Errorf("Command too short: %q", line)
 	case l == 4:
 		return strings.ToUpper(line), "", nil
-	case l == 5:
-		// Too long to be only command, too short to have args
-		return "", "", fmt.Errorf("Mangled command: %q", line)
 	}
 
-	// If we made it here, command is long enough to have args
-	if line[4] != ' ' {
-		// There wasn't a space after the command?
+	// Commands are usually four letters, but extensions may use longer
+	// verbs, e.g. XTRACE
+	cmd = line
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		cmd, arg = line[:i], strings.Trim(line[i+1:], " \n\r")
+	}
+	if len(cmd) < 4 {
 		return "", "", fmt.Errorf("Mangled command: %q", line)
 	}
-
-	// I'm not sure if we should trim the args or not, but we will for now
-	//return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " "), nil
-	return strings.ToUpper(line[0:4]), strings.Trim(line[5:], " \n\r"), nil
+	for _, r := range cmd {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') {
+			return "", "", fmt.Errorf("Mangled command: %q", line)
+		}
+	}
+	return strings.ToUpper(cmd), arg, nil
 }
 
 // Takes the arguments proceeding a command and files them
@@ -66,3 +68,100 @@ func parseHelloArgument(arg string) (string, error) {
 	}
 	return domain, nil
 }
+
+// parsePath parses the path of a MAIL or RCPT command followed by its
+// parameters, e.g. "<user@example.com> SIZE=1024". Spaces in quoted local
+// parts don't end the path and source routes like "<@a,@b:user@c>" are
+// removed (RFC 5321 section 4.1.2). In strict mode the path must be enclosed
+// in angle brackets.
+func parsePath(s string, strict bool) (addr string, params []string, err error) {
+	s = strings.TrimLeft(s, " ")
+	if !strings.HasPrefix(s, "<") {
+		if strict {
+			return "", nil, fmt.Errorf("Missing angle brackets: %q", s)
+		}
+		end := pathEnd(s, ' ')
+		addr, s = strings.TrimSuffix(s[:end], ">"), s[end:]
+	} else {
+		end := pathEnd(s[1:], '>') + 1
+		if end == len(s) {
+			return "", nil, fmt.Errorf("Missing closing angle bracket: %q", s)
+		}
+		addr, s = s[1:end], s[end+1:]
+		if s != "" && s[0] != ' ' && strict {
+			return "", nil, fmt.Errorf("Missing space after path: %q", s)
+		}
+	}
+
+	if strings.HasPrefix(addr, "@") {
+		i := strings.IndexByte(addr, ':')
+		if i < 0 {
+			return "", nil, fmt.Errorf("Malformed source route: %q", addr)
+		}
+		addr = addr[i+1:]
+	}
+	if pathEnd(addr, '<') < len(addr) || pathEnd(addr, '>') < len(addr) {
+		return "", nil, fmt.Errorf("Malformed path: %q", addr)
+	}
+	return addr, strings.Fields(s), nil
+}
+
+// pathEnd returns the index of the first delim in s outside of a quoted
+// string, or len(s).
+func pathEnd(s string, delim byte) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == delim:
+			return i
+		}
+	}
+	return len(s)
+}
+
+// parseReversePath parses the argument of MAIL after "FROM:". The null
+// reverse path "<>" results in an empty address.
+func parseReversePath(s string, strict bool) (addr string, params []string, err error) {
+	if strings.TrimSpace(s) == "" {
+		return "", nil, fmt.Errorf("Missing reverse path")
+	}
+	return parsePath(s, strict)
+}
+
+// parseForwardPath parses the argument of RCPT after "TO:".
+func parseForwardPath(s string, strict bool) (addr string, params []string, err error) {
+	addr, params, err = parsePath(s, strict)
+	if err == nil && addr == "" {
+		err = fmt.Errorf("Missing forward path")
+	}
+	return addr, params, err
+}
+
+// decodeXtext decodes a xtext encoded string as defined in RFC 3461,
+// e.g. "a+2Bb" becomes "a+b".
+func decodeXtext(s string) (string, error) {
+	if !strings.Contains(s, "+") {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '+' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("Malformed xtext: %q", s)
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("Malformed xtext: %q", s)
+		}
+		sb.WriteByte(byte(b))
+		i += 2
+	}
+	return sb.String(), nil
+}
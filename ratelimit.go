@@ -0,0 +1,32 @@
+package smtp
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket paces events to a fixed rate. It holds at most one token, so
+// bursts are spread out evenly instead of being let through at once.
+type tokenBucket struct {
+	locker   sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newTokenBucket(perSecond int) *tokenBucket {
+	return &tokenBucket{interval: time.Second / time.Duration(perSecond)}
+}
+
+// reserve takes a token and returns how long the caller has to wait until
+// the token is available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+
+	if b.next.Before(now) {
+		b.next = now
+	}
+	delay := b.next.Sub(now)
+	b.next = b.next.Add(b.interval)
+	return delay
+}
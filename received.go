@@ -0,0 +1,81 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// protocol returns the protocol name used in the "with" clause of the
+// Received header.
+func (c *Conn) protocol() string {
+	_, isTLS := c.TLSConnectionState()
+	return withProtocol(c.server.lmtp, c.ehlo, c.utf8, isTLS, c.authenticated)
+}
+
+// withProtocol returns the protocol of the "with" clause as registered in
+// RFC 3848 and RFC 6531.
+func withProtocol(lmtp, ehlo, utf8, tls, auth bool) string {
+	if !lmtp && !ehlo {
+		return "SMTP"
+	}
+
+	proto := "ESMTP"
+	if lmtp {
+		proto = "LMTP"
+	}
+	if utf8 {
+		proto = "UTF8" + strings.TrimPrefix(proto, "E")
+	}
+	if tls {
+		proto += "S"
+	}
+	if auth {
+		proto += "A"
+	}
+	return proto
+}
+
+func (s *dataContext) BuildReceivedHeader(by string) string {
+	if by == "" {
+		by = s.domain
+	}
+
+	ip := "unknown"
+	if addr := addrIP(s.state.RemoteAddr); addr != nil {
+		ip = addr.String()
+		if addr.To4() == nil {
+			ip = "IPv6:" + ip
+		}
+	}
+
+	rdns := "unknown"
+	if len(s.state.ReverseDNS) > 0 {
+		rdns = s.state.ReverseDNS[0]
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Received: from %v (%v [%v])\r\n", s.helo, rdns, ip)
+	fmt.Fprintf(&sb, "\tby %v with %v", by, s.protocol)
+	if s.state.TLS.HandshakeComplete {
+		version, ok := tlsVersions[s.state.TLS.Version]
+		if !ok {
+			version = fmt.Sprintf("0x%04x", s.state.TLS.Version)
+		}
+		fmt.Fprintf(&sb, "\r\n\t(using %v with cipher %v)", version, tls.CipherSuiteName(s.state.TLS.CipherSuite))
+	}
+	// The recipient is only disclosed for single recipient messages
+	if len(s.recipients) == 1 {
+		fmt.Fprintf(&sb, "\r\n\tfor <%v>", s.recipients[0])
+	}
+	fmt.Fprintf(&sb, ";\r\n\t%v\r\n", time.Now().Format(time.RFC1123Z))
+	return sb.String()
+}
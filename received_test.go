@@ -0,0 +1,68 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBuildReceivedHeader(t *testing.T) {
+	d := &dataContext{
+		helo:       "client.example.org",
+		protocol:   "ESMTPS",
+		domain:     "mx.example.com",
+		recipients: []string{"root@example.com"},
+		state: ConnectionState{
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 4711},
+			TLS: tls.ConnectionState{
+				HandshakeComplete: true,
+				Version:           tls.VersionTLS12,
+				CipherSuite:       tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			},
+		},
+	}
+
+	h := d.BuildReceivedHeader("")
+	want := "Received: from client.example.org (unknown [192.0.2.1])\r\n" +
+		"\tby mx.example.com with ESMTPS\r\n" +
+		"\t(using TLSv1.2 with cipher TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)\r\n" +
+		"\tfor <root@example.com>;\r\n\t"
+	if !strings.HasPrefix(h, want) || !strings.HasSuffix(h, "\r\n") {
+		t.Fatalf("Invalid Received header:\n%q\nExpected prefix:\n%q", h, want)
+	}
+
+	d.recipients = append(d.recipients, "alice@example.com")
+	d.state.RemoteAddr = &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}
+	h = d.BuildReceivedHeader("relay.example.com")
+	if !strings.Contains(h, "[IPv6:2001:db8::1]") || !strings.Contains(h, "by relay.example.com") {
+		t.Fatalf("Invalid Received header: %q", h)
+	}
+	if strings.Contains(h, "for <") {
+		t.Fatalf("Recipients disclosed in Received header: %q", h)
+	}
+}
+
+func TestWithProtocol(t *testing.T) {
+	tests := []struct {
+		lmtp, ehlo, utf8, tls, auth bool
+		want                        string
+	}{
+		{want: "SMTP"},
+		{ehlo: true, want: "ESMTP"},
+		{ehlo: true, auth: true, want: "ESMTPA"},
+		{ehlo: true, tls: true, want: "ESMTPS"},
+		{ehlo: true, tls: true, auth: true, want: "ESMTPSA"},
+		{ehlo: true, utf8: true, tls: true, auth: true, want: "UTF8SMTPSA"},
+		{lmtp: true, want: "LMTP"},
+		{lmtp: true, auth: true, want: "LMTPA"},
+		{lmtp: true, tls: true, want: "LMTPS"},
+		{lmtp: true, tls: true, auth: true, want: "LMTPSA"},
+		{lmtp: true, utf8: true, want: "UTF8LMTP"},
+	}
+	for _, test := range tests {
+		if got := withProtocol(test.lmtp, test.ehlo, test.utf8, test.tls, test.auth); got != test.want {
+			t.Errorf("withProtocol(%+v) = %q, want %q", test, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// cramMD5 is the name of the CRAM-MD5 mechanism, it is not defined by the
+// sasl package.
+const cramMD5 = "CRAM-MD5"
+
+// externalServer implements the server side of the EXTERNAL mechanism, as
+// described in RFC 4422. The client is authenticated by its TLS client
+// certificate, it only sends the authorization identity.
+type externalServer struct {
+	requested    bool
+	done         bool
+	authenticate func(identity string) error
+}
+
+func (a *externalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.done {
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+
+	// No initial response, request the identity with an empty challenge
+	if response == nil && !a.requested {
+		a.requested = true
+		return []byte{}, false, nil
+	}
+
+	a.done = true
+	return nil, true, a.authenticate(string(response))
+}
+
+// newExternalServer returns a SASL server for the EXTERNAL mechanism calling
+// LoginExternal of the backend.
+func newExternalServer(conn *Conn) sasl.Server {
+	be := conn.server.backend.(ExternalBackend)
+	return &externalServer{authenticate: func(identity string) error {
+		conn.authAttempt = identity
+		state := conn.State()
+		session, err := be.LoginExternal(&state, identity)
+		if err != nil {
+			return err
+		}
+
+		conn.SetSession(session)
+		if identity == "" && len(state.TLS.VerifiedChains) > 0 {
+			// Acting as the identity of the certificate
+			identity = state.TLS.VerifiedChains[0][0].Subject.CommonName
+		}
+		conn.SetAuthenticatedUser(identity)
+		return nil
+	}}
+}
+
+// cramMD5Server implements the server side of the CRAM-MD5 mechanism, as
+// described in RFC 2195. The client proves that it knows the password by
+// sending an HMAC-MD5 digest of a challenge keyed with the password.
+type cramMD5Server struct {
+	domain       string
+	challenge    []byte
+	done         bool
+	authenticate func(username string, challenge, digest []byte) error
+}
+
+func (a *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.done {
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+
+	if a.challenge == nil {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, false, err
+		}
+		a.challenge = []byte(fmt.Sprintf("<%d.%d@%s>", binary.BigEndian.Uint64(b[:]), time.Now().Unix(), a.domain))
+		return a.challenge, false, nil
+	}
+
+	a.done = true
+	parts := strings.Fields(string(response))
+	if len(parts) != 2 {
+		return nil, false, errors.New("Invalid CRAM-MD5 response")
+	}
+	digest, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return nil, false, errors.New("Invalid CRAM-MD5 response")
+	}
+	return nil, true, a.authenticate(parts[0], a.challenge, digest)
+}
+
+// newCramMD5Server returns a SASL server for the CRAM-MD5 mechanism. The
+// shared secret is looked up with GetPassword of the backend, the session is
+// created by Login.
+func newCramMD5Server(conn *Conn) sasl.Server {
+	be := conn.server.backend.(PasswordBackend)
+	return &cramMD5Server{
+		domain: conn.domain(),
+		authenticate: func(username string, challenge, digest []byte) error {
+			conn.authAttempt = username
+			state := conn.State()
+			password, err := be.GetPassword(&state, username)
+			if err != nil {
+				return err
+			}
+
+			mac := hmac.New(md5.New, []byte(password))
+			mac.Write(challenge)
+			if !hmac.Equal(mac.Sum(nil), digest) {
+				return &SMTPError{
+					Code:         535,
+					EnhancedCode: EnhancedCodeInvalidCredentials,
+					Message:      "Invalid username or password",
+				}
+			}
+
+			session, err := conn.server.backend.Login(&state, username, password)
+			if err != nil {
+				return err
+			}
+
+			conn.SetSession(session)
+			conn.SetAuthenticatedUser(username)
+			return nil
+		},
+	}
+}
@@ -1,18 +1,32 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-sasl"
 )
 
+// resolver is implemented by net.Resolver, it can be replaced in tests.
+type resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// defaultLookupTimeout bounds DNS lookups if no read timeout is set.
+const defaultLookupTimeout = 10 * time.Second
+
 // A function that creates SASL servers.
 type SaslServerFactory func(conn *Conn) sasl.Server
 
@@ -52,6 +66,47 @@ func TLSConfig(tlsconfig *tls.Config) Option {
 	})
 }
 
+// PostHandshakeTLSCheck sets a function which is called after every TLS
+// handshake, both for STARTTLS and implicit TLS. If it returns an error the
+// client gets a 550 response and the connection is closed. This can be used
+// to reject weak ciphers or old TLS versions.
+func PostHandshakeTLSCheck(f func(tls.ConnectionState) error) Option {
+	return optionFunc(func(server *Server) {
+		server.postHandshakeTLSCheck = f
+	})
+}
+
+// MinTLSVersion returns a PostHandshakeTLSCheck rejecting connections which
+// negotiated a TLS version older than version, e.g. tls.VersionTLS12. It is
+// useful if the tls.Config is shared with services which can't set
+// MinVersion.
+func MinTLSVersion(version uint16) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if state.Version >= version {
+			return nil
+		}
+		name, ok := tlsVersions[state.Version]
+		if !ok {
+			name = fmt.Sprintf("0x%04x", state.Version)
+		}
+		return &SMTPError{
+			Code:         550,
+			EnhancedCode: EnhancedCodeSecurityError,
+			Message:      name + " is not allowed",
+		}
+	}
+}
+
+// TLSClientAuth sets a function deciding the client certificate policy for
+// STARTTLS based on the connection state before the handshake, e.g. to
+// require client certificates from some networks only. It overrides the
+// ClientAuth of the TLS configuration.
+func TLSClientAuth(f func(state *ConnectionState) tls.ClientAuthType) Option {
+	return optionFunc(func(server *Server) {
+		server.tlsClientAuth = f
+	})
+}
+
 func LMTP() Option {
 	return optionFunc(func(server *Server) {
 		server.lmtp = true
@@ -70,15 +125,243 @@ func Domain(domain string) Option {
 	})
 }
 
+// ServerIdentity sets a software identification (e.g. "go-smtp/1.0") which is
+// announced in the greeting. By default no identification is announced.
+func ServerIdentity(identity string) Option {
+	return optionFunc(func(server *Server) {
+		server.identity = identity
+	})
+}
+
+// MaxRecipients limits the number of recipients of a message. Further
+// recipients are rejected with 452 4.5.3 (RFC 5321 section 4.5.3.1.10), so
+// that the client sends them in another transaction.
 func MaxRecipients(maxRcpts int) Option {
 	return optionFunc(func(server *Server) {
-		server.maxRecipients = maxRcpts
+		server.maxRecipients = int64(maxRcpts)
+	})
+}
+
+// DeduplicateRecipients accepts a recipient given more than once in a
+// transaction without passing it to the Session again, so that it is
+// delivered once and counted once towards MaxRecipients. The domain of the
+// address is compared case-insensitively, the local part case-sensitively.
+// LMTP servers always reject duplicate recipients.
+func DeduplicateRecipients() Option {
+	return optionFunc(func(server *Server) {
+		server.dedupRcpts = true
+	})
+}
+
+// PermanentRecipientLimit rejects recipients over the MaxRecipients limit
+// with 552 5.5.3 instead of 452 4.5.3, for clients which expect the old
+// behaviour of RFC 821.
+func PermanentRecipientLimit() Option {
+	return optionFunc(func(server *Server) {
+		server.permanentRcptLimit = true
 	})
 }
 
 func MaxMessageBytes(maxMsgBytes int) Option {
 	return optionFunc(func(server *Server) {
-		server.maxMessageBytes = maxMsgBytes
+		server.maxMessageBytes = int64(maxMsgBytes)
+	})
+}
+
+// MaxConnections limits the number of concurrent connections, additional
+// connections are rejected with 421. Defaults to 0 (unlimited).
+func MaxConnections(n int) Option {
+	return optionFunc(func(server *Server) {
+		server.maxConnections = int64(n)
+	})
+}
+
+// MaxAcceptRate limits the number of new connections handled per second.
+// Connections exceeding the rate are delayed, not dropped. 0 means
+// unlimited.
+func MaxAcceptRate(perSecond int) Option {
+	return optionFunc(func(server *Server) {
+		server.acceptLimiter = nil
+		if perSecond > 0 {
+			server.acceptLimiter = newTokenBucket(perSecond)
+		}
+	})
+}
+
+// EnableChunking advertises the CHUNKING extension (RFC 3030), allowing
+// clients to send messages with BDAT instead of DATA.
+func EnableChunking() Option {
+	return optionFunc(func(server *Server) {
+		server.chunking = true
+	})
+}
+
+// EnableSMTPUTF8 advertises the SMTPUTF8 extension (RFC 6531), allowing
+// clients to send internationalized addresses and headers. Otherwise the
+// SMTPUTF8 parameter of MAIL is rejected with 555.
+func EnableSMTPUTF8() Option {
+	return optionFunc(func(server *Server) {
+		server.smtputf8 = true
+	})
+}
+
+// EnableRequireTLS advertises the REQUIRETLS extension (RFC 8689) on
+// encrypted connections. Messages sent with the REQUIRETLS parameter must
+// only be relayed over TLS, see DataContext.RequireTLS.
+func EnableRequireTLS() Option {
+	return optionFunc(func(server *Server) {
+		server.requireTLSExt = true
+	})
+}
+
+// EnableATRN advertises the ATRN extension (RFC 2645) for on-demand mail
+// relay. The backend must implement ATRNBackend.
+func EnableATRN() Option {
+	return optionFunc(func(server *Server) {
+		server.atrn = true
+	})
+}
+
+// EnableETRN advertises the ETRN extension (RFC 1985), allowing clients to
+// request a queue run for their domain. The backend must implement
+// ETRNBackend.
+func EnableETRN() Option {
+	return optionFunc(func(server *Server) {
+		server.etrn = true
+	})
+}
+
+// EnableBinaryMIME advertises the BINARYMIME extension (RFC 3030), allowing
+// clients to send binary messages with BDAT. It implies EnableChunking.
+func EnableBinaryMIME() Option {
+	return optionFunc(func(server *Server) {
+		server.chunking = true
+		server.binaryMIME = true
+	})
+}
+
+// MaxDataDuration limits the total time spent receiving a message, in
+// addition to the per-read DataTimeout. If set, it replaces the ReadTimeout
+// of the DATA command as limit for the whole message. With BDAT, it limits
+// the time from the first chunk up to the end of the last one. Clients
+// exceeding it get a 451 response and the connection is closed. 0 means
+// unlimited.
+func MaxDataDuration(d time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.maxDataDuration = d
+	})
+}
+
+// LMTPDeliveryTimeout limits how long the server waits for the status of a
+// recipient after DATA in LMTP mode. It only applies if the context passed
+// to DataContext.StartDelivery has no deadline, a deadline set by the
+// backend always wins. Recipients timing out get a 420 response.
+func LMTPDeliveryTimeout(d time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.lmtpDeliveryTimeout = d
+	})
+}
+
+// MaxErrors sets the number of protocol errors (unrecognized commands, bad
+// syntax, overlong lines) after which the connection is closed with 421.
+// Defaults to 3, 0 means unlimited.
+func MaxErrors(n int) Option {
+	return optionFunc(func(server *Server) {
+		server.maxErrors = n
+	})
+}
+
+// MaxNoopCommands sets the number of commands without progress (NOOP, RSET,
+// HELO, EHLO and LHLO) after which the connection is closed with 421, to
+// prevent clients from holding a connection open forever. The count is
+// reset whenever a message is accepted. Defaults to 0, unlimited.
+func MaxNoopCommands(n int) Option {
+	return optionFunc(func(server *Server) {
+		server.maxNoops = n
+	})
+}
+
+// minBufferSize is the minimum buffer size accepted by BufferSizes,
+// defaultBufferSize is used for smaller sizes.
+const (
+	minBufferSize     = 512
+	defaultBufferSize = 4096
+)
+
+// BufferSizes sets the sizes of the read and write buffers of every
+// connection, larger buffers reduce the number of system calls for large
+// messages. Sizes below 512 bytes fall back to the default of 4096 bytes.
+func BufferSizes(read, write int) Option {
+	return optionFunc(func(server *Server) {
+		if read < minBufferSize {
+			read = defaultBufferSize
+		}
+		if write < minBufferSize {
+			write = defaultBufferSize
+		}
+		server.readBufferSize = read
+		server.writeBufferSize = write
+	})
+}
+
+// MaxLineLength limits the length of command lines, longer lines are
+// rejected. Defaults to 2000, 0 means unlimited.
+func MaxLineLength(n int) Option {
+	return optionFunc(func(server *Server) {
+		server.maxLineLength = n
+	})
+}
+
+// MaxDataLineLength limits the length of the lines of a message, messages with
+// longer lines are rejected. Defaults to 0 (unlimited).
+func MaxDataLineLength(n int) Option {
+	return optionFunc(func(server *Server) {
+		server.maxDataLineLength = n
+	})
+}
+
+// MaxHeaderBytes limits the size of the header section of a message, up to
+// the first empty line. Messages with larger headers are rejected with 552,
+// both with DATA and BDAT.
+// Defaults to 0 (unlimited).
+func MaxHeaderBytes(n int) Option {
+	return optionFunc(func(server *Server) {
+		server.maxHeaderBytes = int64(n)
+	})
+}
+
+// RejectBareLF rejects command lines and messages with lines terminated by a
+// bare LF instead of CRLF. By default bare LFs are accepted and normalized to
+// CRLF in messages.
+func RejectBareLF() Option {
+	return optionFunc(func(server *Server) {
+		server.rejectBareLF = true
+	})
+}
+
+// RejectUnknownParams rejects MAIL and RCPT commands with ESMTP parameters
+// the server doesn't support with 555, as required by RFC 5321. By default
+// unknown parameters are ignored.
+func RejectUnknownParams() Option {
+	return optionFunc(func(server *Server) {
+		server.rejectUnknownParams = true
+	})
+}
+
+// LenientAuthOrder accepts AUTH and MAIL without a prior HELO/EHLO, for
+// broken legacy clients. This deviates from RFC 5321 and RFC 4954, which
+// require the client to introduce itself first.
+func LenientAuthOrder() Option {
+	return optionFunc(func(server *Server) {
+		server.lenientAuthOrder = true
+	})
+}
+
+// RequireTLS rejects MAIL and AUTH commands with 530 until the client has
+// issued STARTTLS. Connections accepted with implicit TLS are not affected.
+func RequireTLS() Option {
+	return optionFunc(func(server *Server) {
+		server.requireTLS = true
 	})
 }
 
@@ -94,6 +377,21 @@ func AllowXForward() Option {
 	})
 }
 
+// AllowXClient enables the XCLIENT command, used by proxies like nginx to
+// pass the original client's attributes. Any client can then claim another
+// address and HELO name, so only use it if the server is solely reachable
+// by trusted proxies.
+func AllowXClient() Option {
+	return optionFunc(func(server *Server) {
+		server.allowXClient = true
+	})
+}
+
+// StrictMode enforces the syntax of RFC 5321, e.g. angle brackets around
+// addresses. Command lines terminated by a bare LF are rejected with 500,
+// which prevents command smuggling through proxies. The end of a message
+// must be marked with <CR><LF>.<CR><LF>, otherwise a dot line following a
+// bare LF is accepted as well.
 func StrictMode() Option {
 	return optionFunc(func(server *Server) {
 		server.strict = true
@@ -124,6 +422,283 @@ func WriteTimeout(t time.Duration) Option {
 	})
 }
 
+// GreetingDelay delays the greeting banner by d. Clients which send anything
+// before the greeting was sent are likely spambots, they are rejected with a
+// 554 response and disconnected.
+func GreetingDelay(d time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.greetingDelay = d
+	})
+}
+
+// LoginRetry retries the session creation at MAIL time up to attempts times
+// if the backend returns a transient error (a 4xx SMTPError or any other
+// error), waiting backoff between the attempts.
+func LoginRetry(attempts int, backoff time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.loginRetries = attempts
+		server.loginBackoff = backoff
+	})
+}
+
+// Messages contains the texts of responses which can be customized with the
+// CustomMessages option. Empty fields fall back to the defaults.
+type Messages struct {
+	// Greeting is the text following the domain in the 220 greeting,
+	// defaults to "ESMTP Service Ready". A configured ServerIdentity is
+	// appended to a custom greeting.
+	Greeting string
+	// Quit is the 221 response to QUIT.
+	Quit string
+	// Noop is the 250 response to NOOP.
+	Noop string
+	// Data is the 354 response to DATA.
+	Data string
+	// IdleTimeout is the 421 response sent when the client timed out.
+	IdleTimeout string
+	// Reject is the 421 response sent by Conn.Reject.
+	Reject string
+}
+
+var defaultMessages = Messages{
+	Quit:        "Goodnight and good luck",
+	Noop:        "I have sucessfully done nothing",
+	Data:        "Go ahead. End your data with <CR><LF>.<CR><LF>",
+	IdleTimeout: "Idle timeout, bye bye",
+	Reject:      "Too busy. Try again later.",
+}
+
+// CustomMessages overrides the texts of responses, see Messages.
+func CustomMessages(m Messages) Option {
+	return optionFunc(func(server *Server) {
+		if m.Greeting != "" {
+			server.messages.Greeting = m.Greeting
+		}
+		if m.Quit != "" {
+			server.messages.Quit = m.Quit
+		}
+		if m.Noop != "" {
+			server.messages.Noop = m.Noop
+		}
+		if m.Data != "" {
+			server.messages.Data = m.Data
+		}
+		if m.IdleTimeout != "" {
+			server.messages.IdleTimeout = m.IdleTimeout
+		}
+		if m.Reject != "" {
+			server.messages.Reject = m.Reject
+		}
+	})
+}
+
+// EnableReverseDNS looks up the PTR records of every client after it connected,
+// see ConnectionState.ReverseDNS. The lookup is bounded by the read timeout.
+func EnableReverseDNS() Option {
+	return optionFunc(func(server *Server) {
+		server.reverseDNS = true
+	})
+}
+
+// FCrDNSPolicy configures the forward-confirmed reverse DNS check, see
+// RequireFCrDNS.
+type FCrDNSPolicy struct {
+	// MatchHelo additionally requires the HELO/EHLO name to be one of the
+	// forward-confirmed names.
+	MatchHelo bool
+	// AtConnect rejects clients without forward-confirmed name right after
+	// they connected instead of at MAIL. The HELO name is always checked at
+	// MAIL.
+	AtConnect bool
+}
+
+// RequireFCrDNS rejects clients with 550 unless one of the PTR names of
+// their address resolves back to it. It implies EnableReverseDNS.
+func RequireFCrDNS(policy FCrDNSPolicy) Option {
+	return optionFunc(func(server *Server) {
+		server.reverseDNS = true
+		server.fcrdns = &policy
+	})
+}
+
+// MailFromRewrite sets a function rewriting the sender address before it is
+// passed to Session.Mail, e.g. for the Sender Rewriting Scheme. An error
+// rejects the MAIL command. The address given by the client is available
+// with Conn.RawMailFrom.
+func MailFromRewrite(f func(state *ConnectionState, from string) (string, error)) Option {
+	return optionFunc(func(server *Server) {
+		server.mailFromRewrite = f
+	})
+}
+
+// PanicHandler sets a function called instead of the default handling when
+// a command handler panics, with the command and the recovered value. The
+// default writes 421 and logs the stack to the ErrorLog. The connection is
+// closed after the handler returns.
+func PanicHandler(f func(c *Conn, cmd string, err interface{})) Option {
+	return optionFunc(func(server *Server) {
+		server.panicHandler = f
+	})
+}
+
+// OnConnectionOpened sets a function called when a connection is accepted,
+// before the greeting is sent.
+func OnConnectionOpened(f func(state *ConnectionState)) Option {
+	return optionFunc(func(server *Server) {
+		server.onConnectionOpened = f
+	})
+}
+
+// OnConnectionClosed sets a function called when a connection is closed, d
+// is the lifetime of the connection.
+func OnConnectionClosed(f func(state *ConnectionState, d time.Duration)) Option {
+	return optionFunc(func(server *Server) {
+		server.onConnectionClosed = f
+	})
+}
+
+// OnTransactionStart sets a function called when the client starts to send
+// a message, cmd is either DATA or BDAT.
+func OnTransactionStart(f func(state *ConnectionState, cmd string)) Option {
+	return optionFunc(func(server *Server) {
+		server.onTransactionStart = f
+	})
+}
+
+// OnTransactionEnd sets a function called after the response to a message
+// has been sent. accepted reports whether the message was accepted, for LMTP
+// whether it was accepted for at least one recipient. bytes is the size of
+// the message received so far and d the time since the transaction started.
+func OnTransactionEnd(f func(state *ConnectionState, accepted bool, bytes int, d time.Duration)) Option {
+	return optionFunc(func(server *Server) {
+		server.onTransactionEnd = f
+	})
+}
+
+// OnRecipientResults sets a function called after the response to a message
+// for which the backend recorded results with DataContext.SetRecipientResult.
+// results maps the lowercased recipients to their status, nil means success.
+func OnRecipientResults(f func(state *ConnectionState, results map[string]*SMTPError)) Option {
+	return optionFunc(func(server *Server) {
+		server.onRecipientResults = f
+	})
+}
+
+// OnAuthAttempt sets a function called after every AUTH command, e.g. to
+// feed brute-force detection. It receives the mechanism, the attempted user
+// name if known and whether the authentication succeeded. Passwords are
+// never passed.
+func OnAuthAttempt(f func(state *ConnectionState, mech, username string, ok bool)) Option {
+	return optionFunc(func(server *Server) {
+		server.onAuthAttempt = f
+	})
+}
+
+// knownCommands contains the commands which can be disabled with
+// DisableCommands.
+var knownCommands = map[string]bool{
+	"HELO": true, "EHLO": true, "LHLO": true, "MAIL": true, "RCPT": true,
+	"DATA": true, "BDAT": true, "RSET": true, "NOOP": true, "QUIT": true,
+	"VRFY": true, "EXPN": true, "AUTH": true, "STARTTLS": true, "ATRN": true,
+	"ETRN": true, "XFORWARD": true, "XCLIENT": true,
+}
+
+// DisableCommands rejects the given commands with a 502 response, e.g. to
+// disable VRFY and EXPN probing. The names are case-insensitive. It panics
+// if a command is unknown.
+func DisableCommands(cmds ...string) Option {
+	disabled := make(map[string]bool, len(cmds))
+	for _, cmd := range cmds {
+		cmd = strings.ToUpper(cmd)
+		if !knownCommands[cmd] {
+			panic(fmt.Sprintf("smtp: cannot disable unknown command %q", cmd))
+		}
+		disabled[cmd] = true
+	}
+	return optionFunc(func(server *Server) {
+		server.disabledCommands = disabled
+	})
+}
+
+// CommandInterceptor sets a function called for every command before it is
+// handled, cmd is uppercased. If it returns true the command is considered
+// handled and the default processing is skipped, the function must write a
+// response with Conn.WriteResponse. This allows to implement custom commands
+// or to block commands.
+func CommandInterceptor(f func(c *Conn, cmd, arg string) (handled bool)) Option {
+	return optionFunc(func(server *Server) {
+		server.commandInterceptor = f
+	})
+}
+
+// Capabilities adds custom extensions to the EHLO response. Use a
+// CapabilityProvider backend for capabilities depending on the connection.
+func Capabilities(caps ...string) Option {
+	return optionFunc(func(server *Server) {
+		server.caps = append(server.caps, caps...)
+	})
+}
+
+// VerboseRset makes the RSET response include the number of discarded
+// recipients, which is useful for debugging.
+func VerboseRset() Option {
+	return optionFunc(func(server *Server) {
+		server.verboseRset = true
+	})
+}
+
+// MaxPipelinedCommands limits the number of commands a client may pipeline
+// without waiting for the responses. If exceeded, the connection is closed.
+// Defaults to 0 (unlimited).
+func MaxPipelinedCommands(n int) Option {
+	return optionFunc(func(server *Server) {
+		server.maxPipelinedCommands = n
+	})
+}
+
+// IdleTimeout limits how long a connection may be idle between commands.
+// Once a command started, reading it is bounded by the ReadTimeout.
+func IdleTimeout(t time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.idleTimeout = t
+	})
+}
+
+// DataTimeout limits how long the server waits for more data of the message
+// after DATA or within a BDAT chunk. Defaults to 0, meaning the read deadline
+// set by ReadTimeout for the command applies to the whole message or chunk.
+func DataTimeout(t time.Duration) Option {
+	return optionFunc(func(server *Server) {
+		server.dataTimeout = t
+	})
+}
+
+// DisableEnhancedStatusCodes stops advertising ENHANCEDSTATUSCODES and omits
+// the enhanced status codes from all responses, for old clients which can't
+// parse them.
+func DisableEnhancedStatusCodes() Option {
+	return optionFunc(func(server *Server) {
+		server.noEnhancedCodes = true
+		caps := server.caps[:0]
+		for _, cap := range server.caps {
+			if cap != "ENHANCEDSTATUSCODES" {
+				caps = append(caps, cap)
+			}
+		}
+		server.caps = caps
+	})
+}
+
+// NewSessionPerTransaction ends the session with Logout after every
+// transaction, the next MAIL creates a new one. Sessions of authenticated
+// clients are only renewed if the backend implements SessionRenewer,
+// otherwise they are kept for the whole connection.
+func NewSessionPerTransaction() Option {
+	return optionFunc(func(server *Server) {
+		server.renewSessions = true
+	})
+}
+
 func DisableAuth() Option {
 	return optionFunc(func(server *Server) {
 		server.authDisabled = true
@@ -132,25 +707,80 @@ func DisableAuth() Option {
 
 // A SMTP server.
 type Server struct {
+	// Limits which can be changed at runtime, accessed atomically. They
+	// are kept first to be 64-bit aligned.
+	maxRecipients   int64
+	maxMessageBytes int64
+	maxConnections  int64
+
 	// TCP or Unix address to listen on.
 	addr string
 	// The server TLS configuration.
 	tlsconfig *tls.Config
+	// Called after the TLS handshake, rejects the connection on error.
+	postHandshakeTLSCheck func(tls.ConnectionState) error
+	// Decides the client certificate policy for STARTTLS.
+	tlsClientAuth func(state *ConnectionState) tls.ClientAuthType
 	// Enable LMTP mode, as defined in RFC 2033.
 	lmtp bool
 	// Network defines if tcp or unix socket. default tcp
 	network string
 
-	domain            string
-	maxRecipients     int
-	maxMessageBytes   int
-	allowInsecureAuth bool
-	allowXForward     bool
-	strict            bool
-	debug             io.Writer
-	errorLog          Logger
-	readTimeout       time.Duration
-	writeTimeout      time.Duration
+	domain               string
+	identity             string
+	maxLineLength        int
+	readBufferSize       int
+	writeBufferSize      int
+	maxDataLineLength    int
+	maxHeaderBytes       int64
+	rejectBareLF         bool
+	rejectUnknownParams  bool
+	allowInsecureAuth    bool
+	requireTLS           bool
+	requireTLSExt        bool
+	lenientAuthOrder     bool
+	acceptLimiter        *tokenBucket
+	lmtpDeliveryTimeout  time.Duration
+	maxDataDuration      time.Duration
+	chunking             bool
+	binaryMIME           bool
+	smtputf8             bool
+	atrn                 bool
+	etrn                 bool
+	allowXForward        bool
+	allowXClient         bool
+	strict               bool
+	debug                io.Writer
+	errorLog             Logger
+	readTimeout          time.Duration
+	writeTimeout         time.Duration
+	idleTimeout          time.Duration
+	greetingDelay        time.Duration
+	noEnhancedCodes      bool
+	renewSessions        bool
+	dataTimeout          time.Duration
+	loginRetries         int
+	loginBackoff         time.Duration
+	messages             Messages
+	reverseDNS           bool
+	fcrdns               *FCrDNSPolicy
+	mailFromRewrite      func(state *ConnectionState, from string) (string, error)
+	panicHandler         func(c *Conn, cmd string, err interface{})
+	onConnectionOpened   func(state *ConnectionState)
+	onConnectionClosed   func(state *ConnectionState, d time.Duration)
+	onTransactionStart   func(state *ConnectionState, cmd string)
+	onTransactionEnd     func(state *ConnectionState, accepted bool, bytes int, d time.Duration)
+	onRecipientResults   func(state *ConnectionState, results map[string]*SMTPError)
+	onAuthAttempt        func(state *ConnectionState, mech, username string, ok bool)
+	commandInterceptor   func(c *Conn, cmd, arg string) bool
+	disabledCommands     map[string]bool
+	verboseRset          bool
+	maxPipelinedCommands int
+	permanentRcptLimit   bool
+	dedupRcpts           bool
+	maxErrors            int
+	maxNoops             int
+	resolver             resolver
 
 	// If set, the AUTH command will not be advertised and authentication
 	// attempts will be rejected. This setting overrides AllowInsecureAuth.
@@ -159,21 +789,26 @@ type Server struct {
 	// The server backend.
 	backend Backend
 
-	listener net.Listener
-	caps     []string
-	auths    map[string]SaslServerFactory
-	done     chan struct{}
-	locker   sync.Mutex
-	conns    map[*Conn]struct{}
+	listeners map[net.Listener]struct{}
+	caps      []string
+	auths     map[string]SaslServerFactory
+	done      chan struct{}
+	closeOnce sync.Once
+	locker    sync.Mutex
+	conns     map[*Conn]struct{}
 }
 
 // new creates a new SMTP server.
 func newServer(be Backend) *Server {
 	return &Server{
-		backend:  be,
-		done:     make(chan struct{}, 1),
-		errorLog: log.New(os.Stderr, "smtp/server ", log.LstdFlags),
-		caps:     []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES"},
+		backend:       be,
+		done:          make(chan struct{}),
+		errorLog:      log.New(os.Stderr, "smtp/server ", log.LstdFlags),
+		messages:      defaultMessages,
+		resolver:      net.DefaultResolver,
+		maxLineLength: 2000,
+		maxErrors:     3,
+		caps:          []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES"},
 		auths: map[string]SaslServerFactory{
 			sasl.Plain: func(conn *Conn) sasl.Server {
 				return sasl.NewPlainServer(func(identity, username, password string) error {
@@ -181,6 +816,7 @@ func newServer(be Backend) *Server {
 						return errors.New("Identities not supported")
 					}
 
+					conn.authAttempt = username
 					state := conn.State()
 					session, err := be.Login(&state, username, password)
 					if err != nil {
@@ -188,18 +824,45 @@ func newServer(be Backend) *Server {
 					}
 
 					conn.SetSession(session)
+					conn.SetAuthenticatedUser(username)
 					return nil
 				})
 			},
 		},
-		conns: make(map[*Conn]struct{}),
+		conns:     make(map[*Conn]struct{}),
+		listeners: make(map[net.Listener]struct{}),
 	}
 }
 
-// Serve accepts incoming connections on the Listener l.
+// ErrServerClosed is returned by Serve, ServeConn, ListenAndServe and
+// ListenAndServeTLS after a call to Close.
+var ErrServerClosed = errors.New("smtp: server closed")
+
+// Serve accepts incoming connections on the Listener l. Serve can be called
+// concurrently with different listeners, e.g. to serve SMTP and submission
+// with a single server. Close stops all of them.
+//
+// Serve always returns a non-nil error. After Close, the returned error is
+// ErrServerClosed.
 func (s *Server) Serve(l net.Listener) error {
-	s.listener = l
-	defer s.Close()
+	s.locker.Lock()
+	select {
+	case <-s.done:
+		s.locker.Unlock()
+		l.Close()
+		return ErrServerClosed
+	default:
+	}
+	s.listeners[l] = struct{}{}
+	s.locker.Unlock()
+
+	defer func() {
+		l.Close()
+
+		s.locker.Lock()
+		delete(s.listeners, l)
+		s.locker.Unlock()
+	}()
 
 	for {
 		c, err := l.Accept()
@@ -207,38 +870,124 @@ func (s *Server) Serve(l net.Listener) error {
 			select {
 			case <-s.done:
 				// we called Close()
-				return nil
+				return ErrServerClosed
 			default:
 				return err
 			}
 		}
 
+		if s.acceptLimiter != nil {
+			if delay := s.acceptLimiter.reserve(time.Now()); delay > 0 {
+				timer := time.NewTimer(delay)
+				select {
+				case <-timer.C:
+				case <-s.done:
+					// we called Close()
+					timer.Stop()
+					c.Close()
+					return ErrServerClosed
+				}
+			}
+		}
+
 		go s.handleConn(newConn(c, s))
 	}
 }
 
+// ServeConn handles a single connection which was accepted by the caller,
+// e.g. with inetd or systemd socket activation. It returns when the
+// connection is closed. The connection is tracked like the ones accepted by
+// Serve, so Close and ForEachConn apply to it. If the server was closed
+// before, the connection is closed and ErrServerClosed is returned.
+func (s *Server) ServeConn(c net.Conn) error {
+	return s.handleConn(newConn(c, s))
+}
+
 func (s *Server) handleConn(c *Conn) error {
 	s.locker.Lock()
+	select {
+	case <-s.done:
+		s.locker.Unlock()
+		c.conn.Close()
+		return ErrServerClosed
+	default:
+	}
 	s.conns[c] = struct{}{}
+	nbrConns := len(s.conns)
 	s.locker.Unlock()
 
+	opened := time.Now()
+	if s.onConnectionOpened != nil {
+		state := c.State()
+		s.onConnectionOpened(&state)
+	}
+
 	defer func() {
 		c.Close()
 
 		s.locker.Lock()
 		delete(s.conns, c)
 		s.locker.Unlock()
+
+		if s.onConnectionClosed != nil {
+			state := c.State()
+			s.onConnectionClosed(&state, time.Since(opened))
+		}
 	}()
 
+	if max := atomic.LoadInt64(&s.maxConnections); max > 0 && int64(nbrConns) > max {
+		c.WriteResponse(421, EnhancedCodeTempSecurityError, "Too many connections, try again later")
+		return nil
+	}
+
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		if s.readTimeout != 0 {
+			tlsConn.SetDeadline(time.Now().Add(s.readTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		if !c.checkTLS() {
+			return nil
+		}
+	}
+
+	if s.reverseDNS {
+		c.lookupReverseDNS()
+	}
+	if s.fcrdns != nil && s.fcrdns.AtConnect && len(c.fcrdns) == 0 {
+		c.WriteResponse(550, EnhancedCodeReverseDNSFailed, "Reverse DNS validation failed")
+		return nil
+	}
+	if !c.checkConnection() {
+		return nil
+	}
+
+	if s.greetingDelay > 0 && !c.waitGreetingDelay() {
+		return nil
+	}
+
 	c.greet()
 
-	for {
-		line, err := c.ReadLine()
+	pipelined := 0
+	for !c.isClosed() {
+		// Commands read without waiting for the client are pipelined
+		if c.text.R.Buffered() == 0 {
+			pipelined = 0
+		}
+		line, err := c.readCommand()
 		if err == nil {
+			pipelined++
+			if s.maxPipelinedCommands > 0 && pipelined > s.maxPipelinedCommands {
+				c.WriteResponse(421, EnhancedCodeTempSecurityError, "Too many pipelined commands")
+				return nil
+			}
+
 			cmd, arg, err := parseCmd(line)
 			if err != nil {
-				c.nbrErrors++
-				c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Bad command")
+				c.WriteResponse(501, EnhancedCodeSyntaxError, "Bad command")
+				c.countError()
 				continue
 			}
 
@@ -248,15 +997,28 @@ func (s *Server) handleConn(c *Conn) error {
 				return nil
 			}
 
+			if err == ErrLineTooLong {
+				c.WriteResponse(500, EnhancedCodeSyntaxError, "Line too long")
+				c.countError()
+				continue
+			}
+
+			if err == ErrBareLF {
+				c.WriteResponse(500, EnhancedCodeSyntaxError, "Bare LF line endings are not allowed")
+				c.countError()
+				continue
+			}
+
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				c.WriteResponse(221, EnhancedCode{2, 4, 2}, "Idle timeout, bye bye")
+				c.WriteResponse(421, EnhancedCodeBadConnection, s.messages.IdleTimeout)
 				return nil
 			}
 
-			c.WriteResponse(221, EnhancedCode{2, 4, 0}, "Connection error, sorry")
+			c.WriteResponse(421, EnhancedCodeNetworkError, "Connection error, sorry")
 			return err
 		}
 	}
+	return nil
 }
 
 // ListenAndServe listens on the network address s.Addr and then calls Serve
@@ -302,25 +1064,72 @@ func (s *Server) ListenAndServeTLS() error {
 
 // Close stops the server.
 func (s *Server) Close() {
-	s.done <- struct{}{}
-	s.listener.Close()
-
 	s.locker.Lock()
 	defer s.locker.Unlock()
 
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+
+	for l := range s.listeners {
+		l.Close()
+	}
 	for conn := range s.conns {
 		conn.Close()
 	}
 }
 
+// SetMaxRecipients changes the MaxRecipients limit, it applies to subsequent
+// RCPT commands. It is safe to call while the server is running.
+func (s *Server) SetMaxRecipients(n int) {
+	atomic.StoreInt64(&s.maxRecipients, int64(n))
+}
+
+// SetMaxMessageBytes changes the MaxMessageBytes limit, it applies to
+// subsequent commands and messages. It is safe to call while the server is
+// running.
+func (s *Server) SetMaxMessageBytes(n int) {
+	atomic.StoreInt64(&s.maxMessageBytes, int64(n))
+}
+
+// SetMaxConnections changes the MaxConnections limit, it applies to
+// subsequent connections. It is safe to call while the server is running.
+func (s *Server) SetMaxConnections(n int) {
+	atomic.StoreInt64(&s.maxConnections, int64(n))
+}
+
 // EnableAuth enables an authentication mechanism on this server.
 //
 // This function should not be called directly, it must only be used by
 // libraries implementing extensions of the SMTP protocol.
 func (s *Server) EnableAuth(name string, f SaslServerFactory) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
 	s.auths[name] = f
 }
 
+// AuthMechanisms returns the names of the enabled authentication mechanisms
+// in sorted order.
+func (s *Server) AuthMechanisms() []string {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	mechs := make([]string, 0, len(s.auths))
+	for name := range s.auths {
+		mechs = append(mechs, name)
+	}
+	sort.Strings(mechs)
+	return mechs
+}
+
+// authMechanism returns the factory of an enabled authentication mechanism.
+func (s *Server) authMechanism(name string) (SaslServerFactory, bool) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	f, ok := s.auths[name]
+	return f, ok
+}
+
 // ForEachConn iterates through all opened connections.
 func (s *Server) ForEachConn(f func(*Conn)) {
 	s.locker.Lock()
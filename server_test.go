@@ -2,22 +2,46 @@ package smtp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"net/mail"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
-	//"github.com/mschneider82/go-smtp"
+
+	"github.com/emersion/go-sasl"
 )
 
 type message struct {
-	From string
-	To   []string
-	Data []byte
+	From       string
+	MailOpts   *MailOptions
+	To         []string
+	RcptOpts   []*RcptOptions
+	Data       []byte
+	Received   string
+	Header     mail.Header
+	Binary     bool
+	RequireTLS bool
 }
 
 type backend struct {
@@ -26,6 +50,45 @@ type backend struct {
 
 	panicOnMail bool
 	userErr     error
+	// anonFailures is the number of AnonymousLogin calls failing with
+	// anonErr before the login succeeds.
+	anonFailures int
+	anonErr      error
+
+	// state passed to the last AnonymousLogin call
+	anonState ConnectionState
+
+	// deliver messages with DataContext.MultiDeliver and record them per
+	// recipient
+	multiDeliver bool
+	delivered    map[string]string
+
+	// start LMTP deliveries without deadline and never finish them
+	lmtpHang bool
+
+	// return from Data without reading the message
+	ignoreData bool
+
+	// record DataContext.SetRecipientResult for every recipient, failing
+	// root@bnd.bund.de
+	recipientResults bool
+
+	// lines of the response after DATA set with DataContext.WriteResponse
+	dataResponse []string
+
+	// reject messages after reading abortAfter bytes, recording
+	// DataContext.BytesRead
+	abortAfter int64
+	bytesRead  int64
+
+	// parse messages with DataContext.ParseMessage, Data is the body
+	parseMessage bool
+
+	// process messages for this long, calling DataContext.Heartbeat
+	slowData time.Duration
+
+	// reject messages with dataErr after reading them
+	dataErr error
 }
 
 func (be *backend) Login(_ *ConnectionState, username, password string) (Session, error) {
@@ -39,10 +102,15 @@ func (be *backend) Login(_ *ConnectionState, username, password string) (Session
 	return &session{backend: be}, nil
 }
 
-func (be *backend) AnonymousLogin(_ *ConnectionState) (Session, error) {
+func (be *backend) AnonymousLogin(state *ConnectionState) (Session, error) {
+	be.anonState = *state
 	if be.userErr != nil {
 		return &session{}, be.userErr
 	}
+	if be.anonFailures > 0 {
+		be.anonFailures--
+		return nil, be.anonErr
+	}
 
 	return &session{backend: be, anonymous: true}, nil
 }
@@ -51,10 +119,15 @@ type session struct {
 	backend   *backend
 	anonymous bool
 
-	msg *message
+	msg    *message
+	cancel context.CancelFunc
 }
 
 func (s *session) Reset() {
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
 	s.msg = &message{}
 }
 
@@ -71,16 +144,88 @@ func (s *session) Mail(from string) error {
 	return nil
 }
 
+func (s *session) MailWithOptions(from string, opts *MailOptions) error {
+	if err := s.Mail(from); err != nil {
+		return err
+	}
+	s.msg.MailOpts = opts
+	return nil
+}
+
 func (s *session) Rcpt(to string) error {
 	s.msg.To = append(s.msg.To, to)
 	return nil
 }
 
+func (s *session) RcptWithOptions(to string, opts *RcptOptions) error {
+	s.msg.RcptOpts = append(s.msg.RcptOpts, opts)
+	return s.Rcpt(to)
+}
+
 func (s *session) Data(r io.Reader, d DataContext) error {
+	if s.backend.ignoreData {
+		return nil
+	}
+
+	if s.backend.recipientResults {
+		for _, rcpt := range s.msg.To {
+			var status *SMTPError
+			if rcpt == "root@bnd.bund.de" {
+				status = &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "No such user"}
+			}
+			d.SetRecipientResult(rcpt, status)
+		}
+	}
+
+	if s.backend.multiDeliver {
+		s.backend.delivered = make(map[string]string)
+		return d.MultiDeliver(func(rcpt string, r io.Reader) *SMTPError {
+			if rcpt == "root@bnd.bund.de" {
+				return &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "No such user"}
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				return &SMTPError{Code: 451, Message: err.Error()}
+			}
+			s.backend.delivered[rcpt] = string(b)
+			return nil
+		})
+	}
+
+	if s.backend.abortAfter > 0 {
+		io.CopyN(ioutil.Discard, r, s.backend.abortAfter)
+		s.backend.bytesRead = d.BytesRead()
+		return &SMTPError{Code: 552, EnhancedCode: EnhancedCode{5, 2, 2}, Message: "Mailbox full"}
+	}
+
+	if s.backend.dataErr != nil {
+		io.Copy(ioutil.Discard, r)
+		return s.backend.dataErr
+	}
+
+	if s.backend.slowData > 0 {
+		for deadline := time.Now().Add(s.backend.slowData); time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+			d.Heartbeat()
+		}
+	}
+
+	if s.backend.parseMessage {
+		m, err := d.ParseMessage()
+		if err != nil {
+			return err
+		}
+		s.msg.Header = m.Header
+		r = m.Body
+	}
+
 	if b, err := ioutil.ReadAll(r); err != nil {
 		return err
 	} else {
 		s.msg.Data = b
+		s.msg.Received = d.BuildReceivedHeader("")
+		s.msg.Binary = d.BinaryMIME()
+		s.msg.RequireTLS = d.RequireTLS()
 		if s.anonymous {
 			s.backend.anonmsgs = append(s.backend.anonmsgs, s.msg)
 		} else {
@@ -88,7 +233,19 @@ func (s *session) Data(r io.Reader, d DataContext) error {
 		}
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
+	if s.backend.dataResponse != nil {
+		d.WriteResponse(250, EnhancedCodeOK, s.backend.dataResponse...)
+	}
+
+	if s.backend.lmtpHang {
+		for _, rcpt := range s.msg.To {
+			d.StartDelivery(context.Background(), rcpt)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	s.cancel = cancel
 	for _, rcpt := range s.msg.To {
 		rcpt := rcpt
 		d.StartDelivery(ctx, rcpt)
@@ -203,8 +360,8 @@ func TestServer_helo(t *testing.T) {
 	}
 }
 
-func testServerAuthenticated(t *testing.T) (be *backend, s *Server, c net.Conn, scanner *bufio.Scanner) {
-	be, s, c, scanner, caps := testServerEhlo(t)
+func testServerAuthenticated(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *Server, c net.Conn, scanner *bufio.Scanner) {
+	be, s, c, scanner, caps := testServerEhlo(t, fn...)
 
 	if _, ok := caps["AUTH PLAIN"]; !ok {
 		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
@@ -271,143 +428,189 @@ func TestServerPanicRecover(t *testing.T) {
 	return
 }
 
-func TestServerBadESMTPVar(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
+func TestServerPanicHandler(t *testing.T) {
+	panics := make(chan string, 1)
+	handler := PanicHandler(func(c *Conn, cmd string, err interface{}) {
+		c.WriteResponse(451, EnhancedCodeTempSystemError, "Try again later")
+		panics <- fmt.Sprintf("%v: %v", cmd, err)
+	})
+	be, s, c, scanner := testServerAuthenticated(t, handler.apply)
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> RABBIT\r\n")
+	be.panicOnMail = true
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book>\r\n")
 	scanner.Scan()
-	if strings.HasPrefix(scanner.Text(), "250 ") {
+	if scanner.Text() != "451 4.3.0 Try again later" {
 		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
-
-	return
+	if p := <-panics; p != "MAIL: Everything is on fire!" {
+		t.Fatal("Invalid panic:", p)
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
 }
 
-func TestServerBadSize(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
+func TestServerGreetingDelay(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, GreetingDelay(50*time.Millisecond).apply)
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SIZE=rabbit\r\n")
+	io.WriteString(c, "EHLO localhost\r\n")
 	scanner.Scan()
-	if strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	if scanner.Text() != "250-Hello localhost" {
+		t.Fatal("Invalid EHLO response:", scanner.Text())
 	}
-
-	return
 }
 
-func TestServerTooBig(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
+func TestServerGreetingDelay_earlyTalker(t *testing.T) {
+	_, s, c, scanner := testServer(t, GreetingDelay(time.Second).apply)
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SIZE=4294967295\r\n")
+	io.WriteString(c, "EHLO localhost\r\n")
 	scanner.Scan()
-	if strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	if scanner.Text() != "554 5.7.0 Protocol violation: data sent before greeting" {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
 	}
-
-	return
 }
 
-func TestServerEmptyTo(t *testing.T) {
+func TestServer_pipelinedDataRejected(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	// The client doesn't wait for the DATA response before sending the body
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n"+
+		"DATA\r\n"+
+		"RCPT TO:<root@gchq.gov.uk>\r\n"+
+		"Hey <3\r\n"+
+		".\r\n"+
+		"NOOP\r\n")
+
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
 		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
-
-	io.WriteString(c, "RCPT TO:\r\n")
 	scanner.Scan()
-	if strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RCPT response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 I have sucessfully done nothing" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
-
-	return
 }
 
-func TestServer(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_disableEnhancedStatusCodes(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, DisableEnhancedStatusCodes().apply)
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	if caps["ENHANCEDSTATUSCODES"] {
+		t.Fatal("ENHANCEDSTATUSCODES capability is present")
 	}
 
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	io.WriteString(c, "NOOP\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RCPT response:", scanner.Text())
+	if scanner.Text() != "250 I have sucessfully done nothing" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
 
 	io.WriteString(c, "DATA\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "354 ") {
+	if scanner.Text() != "502 Missing RCPT TO command." {
 		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
+}
 
-	io.WriteString(c, "Hey <3\r\n")
-	io.WriteString(c, ".\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid DATA response:", scanner.Text())
-	}
+func TestServer_dataMultilineResponse(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
 
-	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
-	}
+	be.dataResponse = []string{"Queued", "Tracking ID 1234"}
 
-	msg := be.messages[0]
-	if msg.From != "root@nsa.gov" {
-		t.Fatal("Invalid mail sender:", msg.From)
-	}
-	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
-		t.Fatal("Invalid mail recipients:", msg.To)
-	}
-	if string(msg.Data) != "Hey <3\n" {
-		t.Fatal("Invalid mail data:", string(msg.Data))
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+
+	for _, want := range []string{"250-Queued", "250 2.0.0 Tracking ID 1234"} {
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid DATA response: %v, want %v", scanner.Text(), want)
+		}
 	}
 }
 
-func TestServer_authDisabled(t *testing.T) {
-	_, s, c, scanner, caps := testServerEhlo(t, authDisabled)
+func TestServer_ehloGolden(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *Server) {
+		EnableChunking().apply(s)
+		Capabilities("x-custom foo").apply(s)
+		s.EnableAuth("LOGIN", s.auths["PLAIN"])
+	})
 	defer s.Close()
 	defer c.Close()
 
-	if _, ok := caps["AUTH PLAIN"]; ok {
-		t.Fatal("AUTH PLAIN capability is present when auth is disabled")
+	io.WriteString(c, "EHLO localhost\r\n")
+	want := []string{
+		"250-Hello localhost",
+		"250-8BITMIME",
+		"250-AUTH LOGIN PLAIN",
+		"250-CHUNKING",
+		"250-ENHANCEDSTATUSCODES",
+		"250-PIPELINING",
+		"250-SIZE 1048576",
+		"250 X-CUSTOM foo",
 	}
-
-	io.WriteString(c, "AUTH PLAIN\r\n")
-	scanner.Scan()
-	if scanner.Text() != "500 5.5.2 Syntax error, AUTH command unrecognized" {
-		t.Fatal("Invalid AUTH response with auth disabled:", scanner.Text())
+	for _, w := range want {
+		scanner.Scan()
+		if scanner.Text() != w {
+			t.Fatalf("Invalid EHLO response: %q, want %q", scanner.Text(), w)
+		}
 	}
 }
 
-func TestServer_otherCommands(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
+func TestServer_commandInterceptor(t *testing.T) {
+	var audit []string
+	interceptor := CommandInterceptor(func(c *Conn, cmd, arg string) bool {
+		audit = append(audit, cmd)
+		switch cmd {
+		case "XTRACE":
+			c.WriteResponse(250, EnhancedCodeOK, "Trace "+arg, "Done")
+			return true
+		case "VRFY":
+			c.WriteResponse(502, EnhancedCodeInvalidCommand, "VRFY disabled")
+			return true
+		}
+		return false
+	})
+	_, s, c, scanner, _ := testServerEhlo(t, interceptor.apply)
 	defer s.Close()
+	defer c.Close()
 
-	io.WriteString(c, "HELP\r\n")
+	io.WriteString(c, "XTRACE abc\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "502 ") {
-		t.Fatal("Invalid HELP response:", scanner.Text())
+	if scanner.Text() != "250-Trace abc" {
+		t.Fatal("Invalid XTRACE response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 Done" {
+		t.Fatal("Invalid XTRACE response:", scanner.Text())
 	}
 
-	io.WriteString(c, "VRFY\r\n")
+	io.WriteString(c, "VRFY root\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "252 ") {
+	if scanner.Text() != "502 5.5.1 VRFY disabled" {
 		t.Fatal("Invalid VRFY response:", scanner.Text())
 	}
 
@@ -417,43 +620,90 @@ func TestServer_otherCommands(t *testing.T) {
 		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
 
-	io.WriteString(c, "RSET\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RSET response:", scanner.Text())
+	if strings.Join(audit, ",") != "EHLO,XTRACE,VRFY,NOOP" {
+		t.Fatal("Invalid intercepted commands:", audit)
 	}
+}
 
-	io.WriteString(c, "QUIT\r\n")
+func TestServer_xforward(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, AllowXForward().apply)
+	defer s.Close()
+	defer c.Close()
+
+	tests := []struct {
+		arg      string
+		code     string
+		xforward XForward
+	}{
+		{"NAME=spike.porcupine.org ADDR=168.100.189.2 PROTO=ESMTP", "250 ", XForward{Name: "spike.porcupine.org", Addr: "168.100.189.2", Proto: "ESMTP"}},
+		{"HELO=spike.porcupine.org", "250 ", XForward{Name: "spike.porcupine.org", Addr: "168.100.189.2", Proto: "ESMTP", Helo: "spike.porcupine.org"}},
+		{"NAME=[UNAVAILABLE] ADDR=[TEMPUNAVAIL]", "250 ", XForward{Proto: "ESMTP", Helo: "spike.porcupine.org"}},
+		{"HELO=a+3Db", "250 ", XForward{Proto: "ESMTP", Helo: "a=b"}},
+		{"PROTO", "501 ", XForward{Proto: "ESMTP", Helo: "a=b"}},
+		{"PROTO=SMTP SOURCE=LOCAL", "501 ", XForward{Proto: "ESMTP", Helo: "a=b"}},
+	}
+	for _, test := range tests {
+		io.WriteString(c, "XFORWARD "+test.arg+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), test.code) {
+			t.Fatalf("Invalid XFORWARD %v response: %v", test.arg, scanner.Text())
+		}
+		s.ForEachConn(func(conn *Conn) {
+			if *conn.XForward != test.xforward {
+				t.Errorf("Invalid XFORWARD %v attributes: %+v, want %+v", test.arg, *conn.XForward, test.xforward)
+			}
+		})
+	}
+
+	io.WriteString(c, "XFORWARD\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "221 ") {
-		t.Fatal("Invalid QUIT response:", scanner.Text())
+	if scanner.Text() != "501 5.5.4 Missing XFORWARD attributes" {
+		t.Fatal("Invalid bare XFORWARD response:", scanner.Text())
 	}
 }
 
-func TestServer_tooManyInvalidCommands(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
+func TestServer_disableCommands(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, DisableCommands("vrfy", "Rset", "atrn").apply, EnableATRN().apply)
 	defer s.Close()
+	defer c.Close()
 
-	// Let's assume XXXX is a non-existing command
-	for i := 0; i < 4; i++ {
-		io.WriteString(c, "XXXX\r\n")
-		scanner.Scan()
-		if !strings.HasPrefix(scanner.Text(), "500 ") {
-			t.Fatal("Invalid invalid command response:", scanner.Text())
-		}
+	if caps["ATRN"] {
+		t.Fatal("ATRN advertised although disabled")
 	}
 
+	io.WriteString(c, "VRFY root\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "500 ") {
-		t.Fatal("Invalid invalid command response:", scanner.Text())
+	if scanner.Text() != "502 5.5.1 VRFY command disabled" {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if scanner.Text() != "502 5.5.1 RSET command disabled" {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Unknown command disabled without panic")
+		}
+	}()
+	DisableCommands("FROB")
 }
 
-func TestServer_tooLongMessage(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_dataBytesRead(t *testing.T) {
+	var errLog bytes.Buffer
+	be, s, c, scanner := testServerAuthenticated(t, func(s *Server) {
+		s.errorLog = log.New(&errLog, "", 0)
+	})
 	defer s.Close()
+	defer c.Close()
 
-	s.maxMessageBytes = 50
+	be.abortAfter = 4
 
 	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
@@ -461,172 +711,3676 @@ func TestServer_tooLongMessage(t *testing.T) {
 	scanner.Scan()
 	io.WriteString(c, "DATA\r\n")
 	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\nThis is a long message\r\n.\r\n")
+	scanner.Scan()
+	if scanner.Text() != "552 5.2.2 Mailbox full" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
 
-	io.WriteString(c, "This is a very long message.\r\n")
-	io.WriteString(c, "Much longer than you can possibly imagine.\r\n")
-	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
-	io.WriteString(c, ".\r\n")
+	// The rest of the message was drained
+	io.WriteString(c, "NOOP\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "552 ") {
-		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
 
-	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	if be.bytesRead != 4 {
+		t.Fatal("Invalid number of bytes read:", be.bytesRead)
+	}
+	if !strings.Contains(errLog.String(), "rejected after 4 bytes: Mailbox full") {
+		t.Fatal("Partial byte count not logged:", errLog.String())
 	}
 }
 
-func TestServer_anonymousUserError(t *testing.T) {
-	be, s, c, scanner, _ := testServerEhlo(t)
+func TestServerBadESMTPVar(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
 	defer c.Close()
 
-	be.userErr = ErrAuthRequired
-
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> RABBIT\r\n")
 	scanner.Scan()
-	if scanner.Text() != "502 5.7.0 Please authenticate first" {
-		t.Fatal("Backend refused anonymous mail but client was permitted:", scanner.Text())
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
+
+	return
 }
 
-func TestServer_anonymousUserOK(t *testing.T) {
-	be, s, c, scanner, _ := testServerEhlo(t)
+func TestServerUnknownParams(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
-	scanner.Scan()
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
-	scanner.Scan()
-	io.WriteString(c, "DATA\r\n")
+	io.WriteString(c, "MAIL FROM:<x> BOGUS=1\r\n")
 	scanner.Scan()
-	io.WriteString(c, "Hey <3\r\n")
-	io.WriteString(c, ".\r\n")
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	s.rejectUnknownParams = true
+
+	io.WriteString(c, "MAIL FROM:<x> BOGUS=1\r\n")
 	scanner.Scan()
+	if scanner.Text() != "555 5.5.4 Unsupported parameter" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
 
+	io.WriteString(c, "MAIL FROM:<x> SIZE=10 BODY=8BITMIME\r\n")
+	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid DATA response:", scanner.Text())
+		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
 
-	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> BOGUS=1\r\n")
+	scanner.Scan()
+	if scanner.Text() != "555 5.5.4 Unsupported parameter" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
 	}
-}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> NOTIFY=NEVER\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
+func TestServerBadSize(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SIZE=rabbit\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	return
+}
+
+func TestServerTooBig(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SIZE=4294967295\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	return
+}
+
+func TestServerEmptyTo(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	return
+}
+
+func TestServer(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+
+	msg := be.messages[0]
+	if msg.From != "root@nsa.gov" {
+		t.Fatal("Invalid mail sender:", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Fatal("Invalid mail recipients:", msg.To)
+	}
+	if string(msg.Data) != "Hey <3\r\n" {
+		t.Fatal("Invalid mail data:", string(msg.Data))
+	}
+}
+
+func TestServer_dataPromptNoEnhancedCode(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	// handleData passes an enhanced code along with 354, it must be dropped
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if scanner.Text() != "354 Go ahead. End your data with <CR><LF>.<CR><LF>" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 2.0.0 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+}
+
+func TestServer_authDisabled(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, authDisabled)
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["AUTH PLAIN"]; ok {
+		t.Fatal("AUTH PLAIN capability is present when auth is disabled")
+	}
+
+	io.WriteString(c, "AUTH PLAIN\r\n")
+	scanner.Scan()
+	if scanner.Text() != "500 5.5.2 Syntax error, AUTH command unrecognized" {
+		t.Fatal("Invalid AUTH response with auth disabled:", scanner.Text())
+	}
+}
+
+func TestServer_otherCommands(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	io.WriteString(c, "HELP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid HELP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "VRFY\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "252 ") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "221 ") {
+		t.Fatal("Invalid QUIT response:", scanner.Text())
+	}
+}
+
+func TestServer_tooManyInvalidCommands(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	// Let's assume XXXX is a non-existing command
+	for i := 0; i < 4; i++ {
+		io.WriteString(c, "XXXX\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "500 ") {
+			t.Fatal("Invalid invalid command response:", scanner.Text())
+		}
+	}
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 ") {
+		t.Fatal("Invalid invalid command response:", scanner.Text())
+	}
+}
+
+func TestServer_tooLongMessage(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	s.maxMessageBytes = 50
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "This is a very long message.\r\n")
+	io.WriteString(c, "Much longer than you can possibly imagine.\r\n")
+	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestServer_anonymousUserError(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.userErr = ErrAuthRequired
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "502 5.7.0 Please authenticate first" {
+		t.Fatal("Backend refused anonymous mail but client was permitted:", scanner.Text())
+	}
+}
+
+func TestServer_retryAfter(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.userErr = &SMTPError{
+		Code:         421,
+		EnhancedCode: EnhancedCode{4, 7, 0},
+		Message:      "Too busy",
+		RetryAfter:   5 * time.Minute,
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "421 4.7.0 Too busy, try again in 300s" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_anonymousUserOK(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
 
 func testStrictServer(t *testing.T) (s *Server, c net.Conn, scanner *bufio.Scanner) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		t.Fatal(err)
+		t.Fatal(err)
+	}
+
+	s = NewServer(
+		new(backend),
+		Domain("localhost"),
+		WriteTimeout(10*time.Second),
+		ReadTimeout(10*time.Second),
+		MaxMessageBytes(1024*1024),
+		MaxRecipients(50),
+		AllowInsecureAuth(),
+		DisableAuth(),
+		StrictMode(),
+	)
+
+	go s.Serve(l)
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner = bufio.NewScanner(c)
+
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "250-Hello localhost" {
+		t.Fatal("Invalid EHLO response:", scanner.Text())
+	}
+
+	expectedCaps := []string{"PIPELINING", "8BITMIME"}
+	caps := make(map[string]bool)
+
+	for scanner.Scan() {
+		s := scanner.Text()
+
+		if strings.HasPrefix(s, "250 ") {
+			caps[strings.TrimPrefix(s, "250 ")] = true
+			break
+		} else {
+			if !strings.HasPrefix(s, "250-") {
+				t.Fatal("Invalid capability response:", s)
+			}
+			caps[strings.TrimPrefix(s, "250-")] = true
+		}
+	}
+
+	for _, cap := range expectedCaps {
+		if !caps[cap] {
+			t.Fatal("Missing capability:", cap)
+		}
+	}
+
+	return
+}
+
+func TestStrictServerGood(t *testing.T) {
+	s, c, scanner := testStrictServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestStrictServerBad(t *testing.T) {
+	s, c, scanner := testStrictServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_lmtpOK(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t, func(s *Server) {
+		s.lmtp = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "LHLO localhost\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "250-Hello localhost" {
+		t.Fatal("Invalid LHLO response:", scanner.Text())
+	}
+
+	for scanner.Scan() {
+		s := scanner.Text()
+
+		if strings.HasPrefix(s, "250 ") {
+			break
+		} else if !strings.HasPrefix(s, "250-") {
+			t.Fatal("Invalid capability response:", s)
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	rcpt1 := scanner.Text()
+	scanner.Scan()
+	rcpt2 := scanner.Text()
+	if !strings.HasPrefix(rcpt1, "250 ") {
+		t.Fatal("Invalid DATA first response:", scanner.Text())
+	}
+	if !strings.HasPrefix(rcpt1, "250 ") {
+		t.Fatal("Invalid DATA second response:", scanner.Text())
+	}
+
+	if rcpt1 != "250 2.0.0 <root@gchq.gov.uk> Finished" {
+		t.Fatal("Invalid responce:", rcpt1)
+	}
+
+	if rcpt2 != "250 2.0.0 <root@bnd.bund.de> Finished" {
+		t.Fatal("Invalid responce:", rcpt2)
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestServer_xclient(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *Server) {
+		s.allowXClient = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["XCLIENT NAME ADDR PORT PROTO HELO LOGIN"] {
+		t.Fatal("XCLIENT capability is missing")
+	}
+
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.1 PORT=4711 NAME=[UNAVAILABLE] HELO=client.example.org LOGIN=user+2Bx\r\n")
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+
+	var conn *Conn
+	s.ForEachConn(func(c *Conn) {
+		conn = c
+	})
+	state := conn.State()
+	if state.RemoteAddr.String() != "192.0.2.1:4711" {
+		t.Fatal("Invalid remote address:", state.RemoteAddr)
+	}
+	if state.Hostname != "client.example.org" {
+		t.Fatal("Invalid hostname:", state.Hostname)
+	}
+	if conn.XClient.Login != "user+x" || conn.XClient.Name != "" {
+		t.Fatal("Invalid XCLIENT attributes:", conn.XClient)
+	}
+
+	io.WriteString(c, "XCLIENT ADDR\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "XCLIENTX ADDR=198.51.100.1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid XCLIENTX response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+	}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "XCLIENT ADDR=198.51.100.1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "503 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+	if addr := conn.State().RemoteAddr.String(); addr != "192.0.2.1:4711" {
+		t.Fatal("Invalid remote address:", addr)
+	}
+}
+
+func TestServer_xclientDisabled(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+}
+
+func TestServer_identity(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *Server) {
+		s.identity = "go-smtp/1.0"
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP go-smtp/1.0 Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+}
+
+func TestServer_noIdentity(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "XXXX\r\n")
+	scanner.Scan()
+	if strings.Contains(scanner.Text(), "go-smtp") {
+		t.Fatal("Identity leaked in response:", scanner.Text())
+	}
+}
+
+func TestServer_loginRetry(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.loginRetries = 1
+		s.loginBackoff = time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	be.anonFailures = 1
+	be.anonErr = errors.New("database reconnecting")
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_loginRetryPermanent(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.loginRetries = 1
+		s.loginBackoff = time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	be.anonFailures = 1
+	be.anonErr = &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 7, 1}, Message: "Go away"}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.7.1 Go away" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_customMessages(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *Server) {
+		CustomMessages(Messages{
+			Greeting: "Mail Service",
+			Quit:     "Bye",
+			Data:     "Send it",
+		}).apply(s)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "220 localhost Mail Service" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if scanner.Text() != "354 Send it" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 I have sucessfully done nothing" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	if scanner.Text() != "221 2.0.0 Bye" {
+		t.Fatal("Invalid QUIT response:", scanner.Text())
+	}
+}
+
+func TestServer_authMechanisms(t *testing.T) {
+	s := NewServer(new(backend))
+	s.EnableAuth(sasl.Login, func(conn *Conn) sasl.Server {
+		return sasl.NewLoginServer(func(username, password string) error {
+			return nil
+		})
+	})
+
+	mechs := s.AuthMechanisms()
+	if len(mechs) != 2 || mechs[0] != sasl.Login || mechs[1] != sasl.Plain {
+		t.Fatal("Invalid auth mechanisms:", mechs)
+	}
+}
+
+func TestServer_enableAuthConcurrent(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.EnableAuth(sasl.Login, func(conn *Conn) sasl.Server {
+				return sasl.NewLoginServer(func(username, password string) error {
+					return nil
+				})
+			})
+		}
+	}()
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+	<-done
+}
+
+func TestServer_pipelinedAfterQuit(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "QUIT\r\nMAIL FROM:<root@nsa.gov>\r\nNOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "221 ") {
+		t.Fatal("Invalid QUIT response:", scanner.Text())
+	}
+
+	if scanner.Scan() {
+		t.Fatal("Unexpected response after QUIT:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+}
+
+func TestServer_tooLongLine(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<"+strings.Repeat("a", 3000)+"@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "500 5.5.2 Line too long" {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_tooLongDataLine(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.maxDataLineLength = 10
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Short\r\n")
+	io.WriteString(c, "This line is too long\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "554 5.6.0 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_maxHeaderBytes(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, MaxHeaderBytes(32).apply)
+	defer s.Close()
+	defer c.Close()
+
+	send := func(msg string) string {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, msg+".\r\n")
+		scanner.Scan()
+		return scanner.Text()
+	}
+
+	// Only the header counts towards the limit
+	if resp := send("Subject: short\r\n\r\n" + strings.Repeat("body line\r\n", 10)); !strings.HasPrefix(resp, "250 ") {
+		t.Fatal("Invalid DATA response:", resp)
+	}
+	if resp := send("Subject: long\r\nX-Spam: " + strings.Repeat("x", 32) + "\r\n\r\nHey\r\n"); resp != "552 5.6.0 Message header too large" {
+		t.Fatal("Invalid DATA response:", resp)
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+}
+
+func TestServer_bareLF(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Subject: mixed\n\r\nLine 1\r\n..dot\nLast\n.\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	if want := "Subject: mixed\r\n\r\nLine 1\r\n.dot\r\nLast\r\n"; string(be.messages[0].Data) != want {
+		t.Fatalf("Invalid mail data: %q, want %q", be.messages[0].Data, want)
+	}
+
+	io.WriteString(c, "NOOP\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_strictDataTerminator(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, StrictMode().apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	// Neither the dot after a bare LF nor a dot line ended by a bare LF
+	// terminate the message
+	io.WriteString(c, "Line 1\n.\nLine 2\r\n.\nLast\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	if want := "Line 1\r\n.\r\nLine 2\r\n\r\nLast\r\n"; string(be.messages[0].Data) != want {
+		t.Fatalf("Invalid mail data: %q, want %q", be.messages[0].Data, want)
+	}
+}
+
+func TestServer_rejectBareLF(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, RejectBareLF().apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "NOOP\n")
+	scanner.Scan()
+	if scanner.Text() != "500 5.5.2 Bare LF line endings are not allowed" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Line 1\r\nLine 2\nLine 3\r\n.\r\n")
+	scanner.Scan()
+	if scanner.Text() != "554 5.6.0 Bare LF line endings are not allowed" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_strictBareLFCommand(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, StrictMode().apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "NOOP\nNOOP\r\n")
+	scanner.Scan()
+	if scanner.Text() != "500 5.5.2 Bare LF line endings are not allowed" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+type lookupBackend struct {
+	*backend
+}
+
+func (be *lookupBackend) Verify(_ *ConnectionState, addr string) ([]string, error) {
+	if addr != "root@nsa.gov" {
+		return nil, &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	return []string{"Root <root@nsa.gov>"}, nil
+}
+
+func (be *lookupBackend) Expand(_ *ConnectionState, list string) ([]string, error) {
+	if list == "empty" {
+		return nil, nil
+	}
+	return []string{"Alice <alice@nsa.gov>", "Bob <bob@nsa.gov>"}, nil
+}
+
+func withLookupBackend(s *Server) {
+	s.backend = &lookupBackend{s.backend.(*backend)}
+}
+
+func TestServer_vrfy(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, withLookupBackend)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "VRFY <root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.1.5 Root <root@nsa.gov>" {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "VRFY alice@nsa.gov\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.1.1 No such user" {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EXPN staff\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250-Alice <alice@nsa.gov>" {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != "250 2.1.5 Bob <bob@nsa.gov>" {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EXPN empty\r\n")
+	scanner.Scan()
+	if scanner.Text() != "252 2.5.0 Cannot EXPN list" {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
+	}
+}
+
+func TestServer_vrfyAnonymous(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, withLookupBackend)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "VRFY <root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "252 ") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "VRFY alice@nsa.gov\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "252 ") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EXPN staff\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
+	}
+}
+
+func TestServer_vrfyDefault(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "VRFY <root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "252 ") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EXPN staff\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
+	}
+}
+
+// testTLSConfig returns a TLS configuration with a self-signed certificate.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"Acme Co"}},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+// testClientCert returns a self-signed TLS client certificate for cn.
+func testClientCert(t *testing.T, cn string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// startTLS issues STARTTLS and returns the upgraded connection.
+func startTLS(t *testing.T, c net.Conn, scanner *bufio.Scanner, config *tls.Config) (*tls.Conn, *bufio.Scanner) {
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+
+	tlsConn := tls.Client(c, config)
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return tlsConn, bufio.NewScanner(tlsConn)
+}
+
+func TestServer_postHandshakeTLSCheck(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+		s.postHandshakeTLSCheck = func(state tls.ConnectionState) error {
+			if state.CipherSuite == tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA {
+				return errors.New("Cipher suite not allowed")
+			}
+			return nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	tlsConn, scanner := startTLS(t, c, scanner, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	})
+	defer tlsConn.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "550 5.7.0 Cipher suite not allowed" {
+		t.Fatal("Invalid response after handshake:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+}
+
+func TestServer_postHandshakeTLSCheckOK(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+		s.postHandshakeTLSCheck = func(state tls.ConnectionState) error {
+			return nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	tlsConn, scanner := startTLS(t, c, scanner, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+
+	io.WriteString(tlsConn, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_minTLSVersion(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+		PostHandshakeTLSCheck(MinTLSVersion(tls.VersionTLS13)).apply(s)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	tlsConn, scanner := startTLS(t, c, scanner, &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	defer tlsConn.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "550 5.7.0 TLSv1.2 is not allowed" {
+		t.Fatal("Invalid response after handshake:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+}
+
+func TestServer_tlsMode(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	tlsConn, scanner := startTLS(t, c, scanner, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+
+	io.WriteString(tlsConn, "EHLO localhost\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+	}
+	io.WriteString(tlsConn, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if be.anonState.TLSMode != TLSStartTLS {
+		t.Fatal("Invalid TLS mode after STARTTLS:", be.anonState.TLSMode)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be = &backend{}
+	s = NewServer(be, Domain("localhost"))
+	defer s.Close()
+	go s.Serve(tls.NewListener(l, testTLSConfig(t)))
+
+	tlsConn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsConn.Close()
+	scanner = bufio.NewScanner(tlsConn)
+	scanner.Scan()
+
+	io.WriteString(tlsConn, "EHLO localhost\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+	}
+	io.WriteString(tlsConn, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if be.anonState.TLSMode != TLSImplicit {
+		t.Fatal("Invalid TLS mode with implicit TLS:", be.anonState.TLSMode)
+	}
+}
+
+func TestServer_sniServerName(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &backend{}
+	s := NewServer(be, Domain("localhost"))
+	defer s.Close()
+	go s.Serve(tls.NewListener(l, testTLSConfig(t)))
+
+	tlsConn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "mx.tenant.example",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsConn.Close()
+	scanner := bufio.NewScanner(tlsConn)
+	scanner.Scan()
+	if scanner.Text() != "220 mx.tenant.example ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	io.WriteString(tlsConn, "EHLO localhost\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+	}
+	sendTestMail(t, tlsConn, scanner)
+
+	if be.anonState.ServerName != "mx.tenant.example" {
+		t.Fatal("Invalid server name:", be.anonState.ServerName)
+	}
+	if received := be.anonmsgs[0].Received; !strings.Contains(received, "by mx.tenant.example with ESMTPS") {
+		t.Fatal("Invalid Received header:", received)
+	}
+}
+
+func TestServer_requireTLSParam(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+		EnableRequireTLS().apply(s)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["REQUIRETLS"]; ok {
+		t.Fatal("REQUIRETLS advertised without TLS")
+	}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> REQUIRETLS\r\n")
+	scanner.Scan()
+	if scanner.Text() != "530 5.7.0 REQUIRETLS needs an encrypted connection" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	tlsConn, scanner := startTLS(t, c, scanner, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+
+	io.WriteString(tlsConn, "EHLO localhost\r\n")
+	advertised := false
+	for scanner.Scan() {
+		advertised = advertised || scanner.Text()[4:] == "REQUIRETLS"
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+	if !advertised {
+		t.Fatal("REQUIRETLS not advertised over TLS")
+	}
+
+	io.WriteString(tlsConn, "MAIL FROM:<root@nsa.gov> REQUIRETLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(tlsConn, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(tlsConn, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(tlsConn, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 1 || !be.anonmsgs[0].RequireTLS || !be.anonmsgs[0].MailOpts.RequireTLS {
+		t.Fatal("REQUIRETLS not passed to the backend")
+	}
+}
+
+func TestServer_sniServerNameInvalid(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := &backend{}
+	s := NewServer(be, Domain("localhost"))
+	defer s.Close()
+	go s.Serve(tls.NewListener(l, testTLSConfig(t)))
+
+	tlsConn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "mx.example\r\nX-Injected: yes",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsConn.Close()
+	scanner := bufio.NewScanner(tlsConn)
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	io.WriteString(tlsConn, "EHLO localhost\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+	}
+	sendTestMail(t, tlsConn, scanner)
+
+	if received := be.anonmsgs[0].Received; strings.Contains(received, "X-Injected") || !strings.Contains(received, "by localhost with ESMTPS") {
+		t.Fatal("Invalid Received header:", received)
+	}
+}
+
+func TestServer_startTLSHandshakeError(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+		s.errorLog = log.New(ioutil.Discard, "", 0)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+
+	// Not a TLS ClientHello
+	io.WriteString(c, "NOOP\r\n")
+	if scanner.Scan() {
+		t.Fatal("Expected connection to be closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_startTLSPipelinedPlaintext(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// The injected command must not be executed after the TLS handshake
+	io.WriteString(c, "STARTTLS\r\nMAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+
+	tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	scanner = bufio.NewScanner(tlsConn)
+
+	io.WriteString(tlsConn, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_requireTLS(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+		s.requireTLS = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["STARTTLS"] {
+		t.Fatal("STARTTLS capability is missing")
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "530 5.7.0 Must issue a STARTTLS command first" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if scanner.Text() != "530 5.7.0 Must issue a STARTTLS command first" {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	tlsConn, scanner := startTLS(t, c, scanner, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+
+	io.WriteString(tlsConn, "EHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	io.WriteString(tlsConn, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+type stubResolver map[string][]string
+
+func (r stubResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	names, ok := r[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+func (r stubResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestServer_requireFCrDNS(t *testing.T) {
+	configure := func(s *Server) {
+		s.reverseDNS = true
+		s.fcrdns = &FCrDNSPolicy{MatchHelo: true}
+		s.resolver = stubResolver{
+			"127.0.0.1":        {"mail.example.org."},
+			"mail.example.org": {"192.0.2.1", "127.0.0.1"},
+		}
+	}
+
+	for helo, want := range map[string]string{
+		"mail.example.org":  "250 ",
+		"MAIL.example.org":  "250 ",
+		"other.example.org": "550 5.7.25 ",
+	} {
+		_, s, c, scanner := testServerGreeted(t, configure)
+
+		io.WriteString(c, "HELO "+helo+"\r\n")
+		scanner.Scan()
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), want) {
+			t.Errorf("Invalid MAIL response for HELO %v: %v", helo, scanner.Text())
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_requireFCrDNSAtConnect(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *Server) {
+		s.reverseDNS = true
+		s.fcrdns = &FCrDNSPolicy{AtConnect: true}
+		// The PTR name doesn't resolve back to the client address
+		s.resolver = stubResolver{
+			"127.0.0.1":        {"mail.example.org."},
+			"mail.example.org": {"192.0.2.1"},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "550 5.7.25 Reverse DNS validation failed" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected connection to be closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_reverseDNS(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.reverseDNS = true
+		s.resolver = stubResolver{"127.0.0.1": {"localhost."}}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	if len(be.anonState.ReverseDNS) != 1 || be.anonState.ReverseDNS[0] != "localhost" {
+		t.Fatal("Invalid reverse DNS:", be.anonState.ReverseDNS)
+	}
+}
+
+func TestServer_reverseDNSFailure(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.reverseDNS = true
+		s.resolver = stubResolver{}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	if len(be.anonState.ReverseDNS) != 0 {
+		t.Fatal("Invalid reverse DNS:", be.anonState.ReverseDNS)
+	}
+}
+
+func TestServer_verboseRset(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.verboseRset = true
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.1.0 Flushed (2 recipients discarded)" {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+}
+
+func TestServer_maxPipelinedCommands(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.maxPipelinedCommands = 5
+
+	io.WriteString(c, strings.Repeat("NOOP\r\n", 10))
+	for i := 0; i < 5; i++ {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid NOOP response:", scanner.Text())
+		}
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 4.7.0 ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+}
+
+func TestServer_idleTimeout(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *Server) {
+		s.idleTimeout = 100 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	scanner.Scan()
+	if scanner.Text() != "421 4.4.2 Idle timeout, bye bye" {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+}
+
+func TestServer_dataTimeout(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.readTimeout = 100 * time.Millisecond
+	s.dataTimeout = 2 * time.Second
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey\r\n")
+	time.Sleep(300 * time.Millisecond)
+	io.WriteString(c, "<3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || string(be.messages[0].Data) != "Hey\r\n<3\r\n" {
+		t.Fatal("Invalid sent messages:", be.messages)
+	}
+}
+
+func tlsClientAuthForNetwork(network string) func(state *ConnectionState) tls.ClientAuthType {
+	_, ipnet, _ := net.ParseCIDR(network)
+	return func(state *ConnectionState) tls.ClientAuthType {
+		if addr, ok := state.RemoteAddr.(*net.TCPAddr); ok && ipnet.Contains(addr.IP) {
+			return tls.RequireAnyClientCert
+		}
+		return tls.NoClientCert
+	}
+}
+
+func TestServer_tlsClientAuthRequired(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+		s.tlsClientAuth = tlsClientAuthForNetwork("127.0.0.0/8")
+		s.errorLog = log.New(ioutil.Discard, "", 0)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+
+	tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	err := tlsConn.Handshake()
+	if err == nil {
+		// With TLS 1.3 the client learns about the rejection on read
+		io.WriteString(tlsConn, "NOOP\r\n")
+		_, err = bufio.NewReader(tlsConn).ReadString('\n')
+	}
+	if err == nil {
+		t.Fatal("Handshake without client certificate succeeded")
+	}
+}
+
+func TestServer_tlsClientAuthNotRequired(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		s.tlsconfig = testTLSConfig(t)
+		s.tlsClientAuth = tlsClientAuthForNetwork("192.0.2.0/24")
+	})
+	defer s.Close()
+	defer c.Close()
+
+	tlsConn, scanner := startTLS(t, c, scanner, &tls.Config{InsecureSkipVerify: true})
+	defer tlsConn.Close()
+
+	io.WriteString(tlsConn, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_rcptOptions(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<Root@GCHQ.gov.uk> NOTIFY=success,failure ORCPT=rfc822;Root+2Bx@GCHQ.gov.uk\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 I'll make sure <Root@GCHQ.gov.uk> gets this" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	msg := be.messages[0]
+	if len(msg.To) != 1 || msg.To[0] != "Root@GCHQ.gov.uk" {
+		t.Fatal("Invalid mail recipients:", msg.To)
+	}
+	opts := msg.RcptOpts[0]
+	if len(opts.Notify) != 2 || opts.Notify[0] != "SUCCESS" || opts.Notify[1] != "FAILURE" {
+		t.Fatal("Invalid NOTIFY parameter:", opts.Notify)
+	}
+	if opts.OriginalRecipient != "rfc822;Root+x@GCHQ.gov.uk" {
+		t.Fatal("Invalid ORCPT parameter:", opts.OriginalRecipient)
+	}
+}
+
+func TestServer_mailAuthParam(t *testing.T) {
+	for _, authenticated := range []bool{true, false} {
+		var be *backend
+		var s *Server
+		var c net.Conn
+		var scanner *bufio.Scanner
+		if authenticated {
+			be, s, c, scanner = testServerAuthenticated(t)
+		} else {
+			be, s, c, scanner, _ = testServerEhlo(t)
+		}
+
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov> AUTH=e+3Dmc2@example.com\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, "Hey <3\r\n.\r\n")
+		scanner.Scan()
+		s.Close()
+		c.Close()
+
+		msgs := be.anonmsgs
+		want := ""
+		if authenticated {
+			msgs = be.messages
+			want = "e=mc2@example.com"
+		}
+		if len(msgs) != 1 {
+			t.Fatal("Invalid number of sent messages:", msgs)
+		}
+		if auth := msgs[0].MailOpts.Auth; auth != want {
+			t.Errorf("Invalid AUTH parameter (authenticated: %v): %q, want %q", authenticated, auth, want)
+		}
+	}
+}
+
+func TestServer_lmtpMultiDeliver(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t, func(s *Server) {
+		s.lmtp = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	be.multiDeliver = true
+
+	io.WriteString(c, "LHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	rcpts := []string{"root@gchq.gov.uk", "root@bnd.bund.de", "root@nsa.gov"}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	for _, rcpt := range rcpts {
+		io.WriteString(c, "RCPT TO:<"+rcpt+">\r\n")
+		scanner.Scan()
+	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+
+	expected := []string{
+		"250 2.0.0 <root@gchq.gov.uk> OK: delivered",
+		"550 5.1.1 <root@bnd.bund.de> No such user",
+		"250 2.0.0 <root@nsa.gov> OK: delivered",
+	}
+	for _, want := range expected {
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+	}
+
+	if len(be.delivered) != 2 || be.delivered["root@gchq.gov.uk"] != "Hey <3\r\n" || be.delivered["root@nsa.gov"] != "Hey <3\r\n" {
+		t.Fatal("Invalid delivered messages:", be.delivered)
+	}
+}
+
+func TestServer_receivedProtocol(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, EnableSMTPUTF8().apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> SMTPUTF8\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || !strings.Contains(be.messages[0].Received, "with UTF8SMTPA") {
+		t.Fatal("Invalid Received header:", be.messages)
+	}
+
+	// A failed MAIL doesn't leak SMTPUTF8 into the next transaction
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> SMTPUTF8 SIZE=x\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	sendTestMail(t, c, scanner)
+	if len(be.messages) != 2 || !strings.Contains(be.messages[1].Received, "with ESMTPA") {
+		t.Fatal("Invalid Received header:", be.messages)
+	}
+}
+
+func TestServer_smtputf8(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	if caps["SMTPUTF8"] {
+		t.Fatal("SMTPUTF8 advertised although disabled")
+	}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> SMTPUTF8\r\n")
+	scanner.Scan()
+	if scanner.Text() != "555 5.5.4 SMTPUTF8 not supported" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	_, s, c, _, caps = testServerEhlo(t, EnableSMTPUTF8().apply)
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["SMTPUTF8"] {
+		t.Fatal("SMTPUTF8 not advertised")
+	}
+}
+
+func TestServer_maxAcceptRate(t *testing.T) {
+	_, s, c, scanner := testServer(t, MaxAcceptRate(20).apply)
+	defer s.Close()
+	defer c.Close()
+
+	start := time.Now()
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	for i := 0; i < 4; i++ {
+		c, err := net.Dial("tcp", c.RemoteAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		scanner := bufio.NewScanner(c)
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "220 ") {
+			t.Fatal("Invalid greeting:", scanner.Text())
+		}
+	}
+
+	// 5 connections at 20 per second take at least 200ms
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Fatal("Connections accepted too fast:", elapsed)
+	}
+}
+
+func TestServer_maxAcceptRateClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(&backend{}, MaxAcceptRate(1))
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	s.Close()
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Fatal("Serve returned an error:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+}
+
+func TestServer_lmtpDeliveryTimeout(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t, func(s *Server) {
+		s.lmtp = true
+		s.lmtpDeliveryTimeout = 50 * time.Millisecond
+		s.errorLog = log.New(ioutil.Discard, "", 0)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	be.lmtpHang = true
+
+	io.WriteString(c, "LHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+
+	for _, rcpt := range []string{"root@gchq.gov.uk", "root@bnd.bund.de"} {
+		scanner.Scan()
+		if scanner.Text() != "420 4.4.7 <"+rcpt+"> Error: timeout reached" {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+	}
+}
+
+func TestServer_lmtpDeliveryNotStarted(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t, func(s *Server) {
+		s.lmtp = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "LHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	for _, want := range []string{"451 4.0.0 <root@gchq.gov.uk> Error: delivery not started", "552 5.2.2 <root@gchq.gov.uk> Mailbox full"} {
+		be.ignoreData = true
+		if strings.HasPrefix(want, "552 ") {
+			be.ignoreData = false
+			be.abortAfter = 1
+		}
+
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, "Hey <3\r\n.\r\n")
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid DATA response: %v, want %v", scanner.Text(), want)
+		}
+	}
+}
+
+func TestServer_dataNotRead(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *Server) {
+		s.maxMessageBytes = 16
+	})
+	defer s.Close()
+	defer c.Close()
+
+	be.ignoreData = true
+
+	sendMessage := func(body string) {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, body+".\r\n")
+		scanner.Scan()
+	}
+
+	sendMessage("Hey <3\r\n")
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	// Too large, but small enough to be discarded
+	sendMessage(strings.Repeat("Hey <3\r\n", 3))
+	if scanner.Text() != "552 5.3.4 Maximum message size exceeded" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	// Too large to be discarded, the connection is closed
+	sendMessage(strings.Repeat("Hey <3\r\n", 10))
+	if scanner.Text() != "552 5.3.4 Maximum message size exceeded" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected connection to be closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_multipleListeners(t *testing.T) {
+	be := &backend{}
+	s := NewServer(be, Domain("localhost"))
+
+	var addrs []string
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, l.Addr().String())
+		go func() {
+			errs <- s.Serve(l)
+		}()
+	}
+
+	for _, addr := range addrs {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+
+		scanner := bufio.NewScanner(c)
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "220 ") {
+			t.Fatal("Invalid greeting:", scanner.Text())
+		}
+	}
+
+	s.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != ErrServerClosed {
+				t.Fatal("Serve returned an error:", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Serve did not return after Close")
+		}
+	}
+
+	for _, addr := range addrs {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			t.Fatal("Listener still open:", addr)
+		}
+	}
+}
+
+func TestServer_maxErrors(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *Server) {
+		s.maxErrors = 2
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "XXXX\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+
+	// Syntax errors count toward the same limit
+	io.WriteString(c, "\x00\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+
+	io.WriteString(c, "YYYY\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != "421 4.7.0 Too many errors, closing connection" {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected connection to be closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_maxErrorsUnlimited(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *Server) {
+		s.maxErrors = 0
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for i := 0; i < 10; i++ {
+		io.WriteString(c, "XXXX\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "500 ") {
+			t.Fatal("Invalid response:", scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_parseMessage(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.parseMessage = true
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "From: root@nsa.gov\r\n")
+	io.WriteString(c, "Subject: Hello\r\n")
+	io.WriteString(c, "\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	msg := be.messages[0]
+	if msg.Header.Get("Subject") != "Hello" || msg.Header.Get("From") != "root@nsa.gov" {
+		t.Fatal("Invalid message header:", msg.Header)
+	}
+	if string(msg.Data) != "Hey <3\r\n" {
+		t.Fatal("Invalid message body:", string(msg.Data))
+	}
+}
+
+func TestServer_mailFromRewrite(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *Server) {
+		s.mailFromRewrite = func(_ *ConnectionState, from string) (string, error) {
+			if from == "spammer@example.org" {
+				return "", &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 7, 1}, Message: "Sender rejected"}
+			}
+			parts := strings.SplitN(from, "@", 2)
+			return "SRS0=HHH=TT=" + parts[1] + "=" + parts[0] + "@forwarder.example.com", nil
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<spammer@example.org>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.7.1 Sender rejected" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 Roger, accepting mail from <root@nsa.gov>" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || be.messages[0].From != "SRS0=HHH=TT=nsa.gov=root@forwarder.example.com" {
+		t.Fatal("Invalid rewritten sender:", be.messages)
+	}
+}
+
+type externalBackend struct {
+	*backend
+	identity string
+}
+
+func (be *externalBackend) LoginExternal(state *ConnectionState, identity string) (Session, error) {
+	be.identity = identity
+	if state.TLS.PeerCertificates[0].Subject.CommonName != "alice" {
+		return nil, errors.New("Unknown certificate")
+	}
+	return &session{backend: be.backend}, nil
+}
+
+func TestServer_authExternal(t *testing.T) {
+	clientCert, cert := testClientCert(t, "alice")
+	var extBe *externalBackend
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *Server) {
+		extBe = &externalBackend{backend: s.backend.(*backend)}
+		s.backend = extBe
+		s.tlsconfig = testTLSConfig(t)
+		s.tlsconfig.ClientCAs = x509.NewCertPool()
+		s.tlsconfig.ClientCAs.AddCert(cert)
+		s.tlsconfig.ClientAuth = tls.VerifyClientCertIfGiven
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for cap := range caps {
+		if strings.HasPrefix(cap, "AUTH ") && strings.Contains(cap, "EXTERNAL") {
+			t.Fatal("AUTH EXTERNAL advertised without client certificate")
+		}
+	}
+	io.WriteString(c, "AUTH EXTERNAL =\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	tlsConn, scanner := startTLS(t, c, scanner, &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+	})
+	defer tlsConn.Close()
+
+	io.WriteString(tlsConn, "EHLO localhost\r\n")
+	external := false
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text()[4:], "AUTH ") && strings.Contains(scanner.Text(), "EXTERNAL") {
+			external = true
+		}
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+	if !external {
+		t.Fatal("AUTH EXTERNAL not advertised with client certificate")
+	}
+
+	io.WriteString(tlsConn, "AUTH EXTERNAL\r\n")
+	scanner.Scan()
+	if scanner.Text() != "334 " {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+	io.WriteString(tlsConn, "YWxpY2U=\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+	if extBe.identity != "alice" {
+		t.Fatal("Invalid authorization identity:", extBe.identity)
+	}
+
+	io.WriteString(tlsConn, "MAIL FROM:<alice@example.org>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	if be.anonState.TLS.HandshakeComplete {
+		t.Fatal("Authenticated client logged in anonymously")
+	}
+}
+
+type capabilityBackend struct {
+	*backend
+}
+
+func (be *capabilityBackend) EHLOCapabilities(state *ConnectionState) []string {
+	caps := []string{"XDELIVERBY", "PIPELINING"}
+	if state.TLS.HandshakeComplete {
+		caps = append(caps, "XSECURE")
+	}
+	return caps
+}
+
+func TestServer_capabilities(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, Capabilities("NO-SOLICITING", "8BITMIME").apply, func(s *Server) {
+		s.backend = &capabilityBackend{s.backend.(*backend)}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	caps := make(map[string]int)
+	for scanner.Scan() {
+		caps[scanner.Text()[4:]]++
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	for _, cap := range []string{"NO-SOLICITING", "XDELIVERBY", "PIPELINING", "8BITMIME"} {
+		if caps[cap] != 1 {
+			t.Errorf("Capability %v advertised %v times", cap, caps[cap])
+		}
+	}
+	if caps["XSECURE"] != 0 {
+		t.Error("XSECURE advertised without TLS")
+	}
+}
+
+func TestServer_maxDataDuration(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *Server) {
+		s.dataTimeout = time.Second
+		s.maxDataDuration = 200 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	// Every line is within the DataTimeout, the message is not
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if _, err := io.WriteString(c, "Hey <3\r\n"); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	scanner.Scan()
+	if scanner.Text() != "451 4.4.2 Maximum DATA duration exceeded" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected connection to be closed, got:", scanner.Text())
+	}
+	<-done
+}
+
+func TestServer_bdatDataTimeout(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, EnableChunking().apply)
+	defer s.Close()
+	defer c.Close()
+
+	s.readTimeout = 100 * time.Millisecond
+	s.dataTimeout = 2 * time.Second
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 9 LAST\r\nHey\r\n")
+	time.Sleep(300 * time.Millisecond)
+	io.WriteString(c, "<3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || string(be.messages[0].Data) != "Hey\r\n<3\r\n" {
+		t.Fatal("Invalid sent messages:", be.messages)
+	}
+}
+
+func TestServer_bdatMaxDataDuration(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, EnableChunking().apply, func(s *Server) {
+		s.dataTimeout = time.Second
+		s.maxDataDuration = 200 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	// Every byte is within the DataTimeout, the chunk is not
+	io.WriteString(c, "BDAT 80 LAST\r\n")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			if _, err := io.WriteString(c, "Hey <3\r\n"); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	scanner.Scan()
+	if scanner.Text() != "451 4.4.2 Maximum DATA duration exceeded" {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected connection to be closed, got:", scanner.Text())
+	}
+	<-done
+}
+
+func TestServer_bdat(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, EnableChunking().apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	// Chunks are not dot-stuffed and may end anywhere
+	io.WriteString(c, "BDAT 8\r\nHey <3\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 8 octets received" {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	io.WriteString(c, "BDAT 5\r\n.\r\nBy")
+	io.WriteString(c, "BDAT 3 LAST\r\ne\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 5 octets received" {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT LAST response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || string(be.messages[0].Data) != "Hey <3\r\n.\r\nBye\r\n" {
+		t.Fatal("Invalid message:", be.messages)
+	}
+	if be.messages[0].Binary {
+		t.Fatal("Message flagged as binary")
+	}
+
+	// BDAT without transaction, the chunk is discarded
+	io.WriteString(c, "BDAT 6 LAST\r\nNOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "503 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+func TestServer_bdatTooLarge(t *testing.T) {
+	var ended int32
+	_, s, c, scanner := testServerAuthenticated(t, EnableChunking().apply, func(s *Server) {
+		s.maxMessageBytes = 10
+	}, OnTransactionEnd(func(state *ConnectionState, accepted bool, bytes int, d time.Duration) {
+		atomic.AddInt32(&ended, 1)
+	}).apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 8\r\nHey <3\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 8 LAST\r\nHey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+	if n := atomic.LoadInt32(&ended); n != 1 {
+		t.Fatal("OnTransactionEnd called", n, "times, want 1")
+	}
+}
+
+func TestServer_bdatMaxHeaderBytes(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, EnableChunking().apply, MaxHeaderBytes(32).apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 15\r\nSubject: long\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	chunk := "X-Spam: " + strings.Repeat("x", 32) + "\r\n\r\nHey\r\n"
+	io.WriteString(c, fmt.Sprintf("BDAT %v LAST\r\n%v", len(chunk), chunk))
+	scanner.Scan()
+	if scanner.Text() != "552 5.6.0 Message header too large" {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+	if len(be.messages) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+}
+
+func TestServer_bdatRetryAfter(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, EnableChunking().apply)
+	defer s.Close()
+	defer c.Close()
+
+	be.dataErr = &SMTPError{
+		Code:         451,
+		EnhancedCode: EnhancedCodeTempSystemError,
+		Message:      "Queue full",
+		RetryAfter:   time.Minute,
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 8 LAST\r\nHey <3\r\n")
+	scanner.Scan()
+	if scanner.Text() != "451 4.3.0 Queue full, try again in 60s" {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+}
+
+func TestServer_binaryMIME(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, EnableBinaryMIME().apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "503 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 4 LAST\r\n\x00\xff\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	if len(be.messages) != 1 || !be.messages[0].Binary || string(be.messages[0].Data) != "\x00\xff\r\n" {
+		t.Fatal("Invalid message:", be.messages)
+	}
+}
+
+func TestServer_binaryMIMEDisabled(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, EnableChunking().apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "555 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_lenientAuthOrder(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, LenientAuthOrder().apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_authBeforeEhlo(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+}
+
+func TestServer_observer(t *testing.T) {
+	events := make(chan string, 10)
+	_, s, c, scanner := testServerAuthenticated(t, func(s *Server) {
+		OnConnectionOpened(func(state *ConnectionState) {
+			events <- "opened"
+		}).apply(s)
+		OnConnectionClosed(func(state *ConnectionState, d time.Duration) {
+			events <- "closed " + state.Hostname
+		}).apply(s)
+		OnAuthAttempt(func(state *ConnectionState, mech, username string, ok bool) {
+			events <- fmt.Sprintf("auth %v %v %v", mech, username, ok)
+		}).apply(s)
+		OnTransactionStart(func(state *ConnectionState, cmd string) {
+			events <- "start " + cmd
+		}).apply(s)
+		OnTransactionEnd(func(state *ConnectionState, accepted bool, bytes int, d time.Duration) {
+			events <- fmt.Sprintf("end %v %v", accepted, bytes)
+		}).apply(s)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+
+	want := []string{"opened", "auth PLAIN username true", "start DATA", "end true 8", "closed localhost"}
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e != w {
+				t.Fatalf("Invalid event: %q, want %q", e, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Missing event %q", w)
+		}
+	}
+}
+
+func TestServer_authAttempt(t *testing.T) {
+	attempts := make(chan string, 10)
+	_, s, c, scanner, _ := testServerEhlo(t, OnAuthAttempt(func(state *ConnectionState, mech, username string, ok bool) {
+		attempts <- fmt.Sprintf("%v %v %v", mech, username, ok)
+	}).apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "AUTH CRAZY\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHdyb25n\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "454 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	want := []string{"CRAZY  false", "PLAIN username false", "PLAIN username true"}
+	for _, w := range want {
+		if a := <-attempts; a != w {
+			t.Fatalf("Invalid attempt: %q, want %q", a, w)
+		}
+	}
+}
+
+func TestSpoolReader(t *testing.T) {
+	for _, maxMem := range []int{1024, 4} {
+		rs, cleanup, err := SpoolReader(strings.NewReader("Hey <3\r\n"), maxMem)
+		if err != nil {
+			t.Fatal("Failed to spool:", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := rs.Seek(0, io.SeekStart); err != nil {
+				t.Fatal("Failed to seek:", err)
+			}
+			b, err := ioutil.ReadAll(rs)
+			if err != nil {
+				t.Fatal("Failed to read:", err)
+			}
+			if string(b) != "Hey <3\r\n" {
+				t.Fatalf("Invalid spooled data (maxMem %v): %q", maxMem, b)
+			}
+		}
+
+		f, isFile := rs.(*os.File)
+		if isFile != (maxMem == 4) {
+			t.Fatalf("Spooled to file: %v, maxMem %v", isFile, maxMem)
+		}
+		cleanup()
+		if isFile {
+			if _, err := os.Stat(f.Name()); !os.IsNotExist(err) {
+				t.Fatal("Temporary file not removed:", err)
+			}
+		}
+	}
+}
+
+func TestServer_setLimits(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.SetMaxRecipients(1)
+	s.SetMaxMessageBytes(1000)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> SIZE=2000\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<alice@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "452 4.5.3 Maximum limit of 1 recipients reached" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	PermanentRecipientLimit().apply(s)
+	io.WriteString(c, "RCPT TO:<alice@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "552 5.5.3 Maximum limit of 1 recipients reached" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	s.SetMaxConnections(1)
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	if scanner2.Text() != "421 4.7.0 Too many connections, try again later" {
+		t.Fatal("Invalid greeting:", scanner2.Text())
+	}
+	if scanner2.Scan() {
+		t.Fatal("Connection not closed:", scanner2.Text())
+	}
+}
+
+func TestServer_dataHeartbeat(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, WriteTimeout(50*time.Millisecond).apply)
+	defer s.Close()
+	defer c.Close()
+
+	be.slowData = 200 * time.Millisecond
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+}
+
+type passwordBackend struct {
+	*backend
+}
+
+func (be *passwordBackend) GetPassword(_ *ConnectionState, username string) (string, error) {
+	if username != "username" {
+		return "", errors.New("Invalid username or password")
+	}
+	return "password", nil
+}
+
+func cramMD5Response(t *testing.T, challenge, username, password string) string {
+	b, err := base64.StdEncoding.DecodeString(challenge)
+	if err != nil {
+		t.Fatal("Invalid challenge:", err)
+	}
+	mac := hmac.New(md5.New, []byte(password))
+	mac.Write(b)
+	resp := username + " " + hex.EncodeToString(mac.Sum(nil))
+	return base64.StdEncoding.EncodeToString([]byte(resp))
+}
+
+func TestServer_authCramMD5(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *Server) {
+		s.backend = &passwordBackend{backend: s.backend.(*backend)}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["AUTH CRAM-MD5 PLAIN"] {
+		t.Fatal("CRAM-MD5 is not advertised:", caps)
+	}
+
+	for _, password := range []string{"wrong", "password"} {
+		io.WriteString(c, "AUTH CRAM-MD5\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "334 ") {
+			t.Fatal("Invalid AUTH response:", scanner.Text())
+		}
+		challenge := strings.TrimPrefix(scanner.Text(), "334 ")
+
+		io.WriteString(c, cramMD5Response(t, challenge, "username", password)+"\r\n")
+		scanner.Scan()
+		want := "535 5.7.8 Invalid username or password"
+		if password == "password" {
+			want = "235 2.0.0 Authentication succeeded"
+		}
+		if scanner.Text() != want {
+			t.Fatalf("Invalid AUTH response: %v, want %v", scanner.Text(), want)
+		}
+	}
+}
+
+type renewBackend struct {
+	*backend
+	logins   int
+	renewals []string
+}
+
+func (be *renewBackend) AnonymousLogin(state *ConnectionState) (Session, error) {
+	be.logins++
+	return be.backend.AnonymousLogin(state)
+}
+
+func (be *renewBackend) RenewSession(_ *ConnectionState, username string) (Session, error) {
+	be.renewals = append(be.renewals, username)
+	return &session{backend: be.backend}, nil
+}
+
+func TestServer_clearedSessionNotRenewable(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	s.ForEachConn(func(conn *Conn) {
+		conn.SetSession(nil)
+	})
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "530 5.7.0 Session expired, please authenticate again" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func sendTestMail(t *testing.T, c net.Conn, scanner *bufio.Scanner) {
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+}
+
+func TestServer_newSessionPerTransaction(t *testing.T) {
+	var renewBe *renewBackend
+	withRenew := func(s *Server) {
+		renewBe = &renewBackend{backend: s.backend.(*backend)}
+		s.backend = renewBe
+		NewSessionPerTransaction().apply(s)
+	}
+
+	_, s, c, scanner, _ := testServerEhlo(t, withRenew)
+	sendTestMail(t, c, scanner)
+	sendTestMail(t, c, scanner)
+	if renewBe.logins != 2 {
+		t.Errorf("Invalid number of anonymous logins: %v, want 2", renewBe.logins)
+	}
+	s.Close()
+	c.Close()
+
+	_, s, c, scanner = testServerAuthenticated(t, withRenew)
+	defer s.Close()
+	defer c.Close()
+	sendTestMail(t, c, scanner)
+	sendTestMail(t, c, scanner)
+	if renewBe.logins != 0 || len(renewBe.renewals) != 1 || renewBe.renewals[0] != "username" {
+		t.Errorf("Invalid logins: %v anonymous, renewed %v", renewBe.logins, renewBe.renewals)
+	}
+}
+
+type resetBackend struct {
+	*backend
+	reasons []ResetReason
+}
+
+func (be *resetBackend) AnonymousLogin(state *ConnectionState) (Session, error) {
+	s, err := be.backend.AnonymousLogin(state)
+	if err != nil {
+		return nil, err
 	}
+	return &resetSession{session: s.(*session), be: be}, nil
+}
 
-	s = NewServer(
-		new(backend),
-		Domain("localhost"),
-		WriteTimeout(10*time.Second),
-		ReadTimeout(10*time.Second),
-		MaxMessageBytes(1024*1024),
-		MaxRecipients(50),
-		AllowInsecureAuth(),
-		DisableAuth(),
-		StrictMode(),
-	)
+type resetSession struct {
+	*session
+	be *resetBackend
+}
+
+func (s *resetSession) ResetWithReason(reason ResetReason) {
+	s.be.reasons = append(s.be.reasons, reason)
+	s.session.Reset()
+}
+
+func TestServer_resetReason(t *testing.T) {
+	var resetBe *resetBackend
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		resetBe = &resetBackend{backend: s.backend.(*backend)}
+		s.backend = resetBe
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	want := []ResetReason{ResetCommand, ResetTransactionEnd}
+	if len(resetBe.reasons) != len(want) {
+		t.Fatalf("Invalid reset reasons: %v, want %v", resetBe.reasons, want)
+	}
+	for i, r := range want {
+		if resetBe.reasons[i] != r {
+			t.Fatalf("Invalid reset reasons: %v, want %v", resetBe.reasons, want)
+		}
+	}
+}
+
+type lazyBackend struct {
+	*backend
+	logins int
+}
+
+func (be *lazyBackend) AnonymousLogin(state *ConnectionState) (Session, error) {
+	be.logins++
+	return be.backend.AnonymousLogin(state)
+}
+
+func (be *lazyBackend) ValidateEnvelope(_ *ConnectionState, from string, to []string) error {
+	if len(to) > 0 && to[len(to)-1] == "root@bnd.bund.de" {
+		return &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "No such user"}
+	}
+	return nil
+}
+
+func TestServer_lazySession(t *testing.T) {
+	var lazyBe *lazyBackend
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		lazyBe = &lazyBackend{backend: s.backend.(*backend)}
+		s.backend = lazyBe
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.1.1 No such user" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	if lazyBe.logins != 0 {
+		t.Fatal("Session created before DATA")
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if lazyBe.logins != 1 {
+		t.Fatal("Invalid number of sessions:", lazyBe.logins)
+	}
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+	msg := be.anonmsgs[0]
+	if msg.From != "root@nsa.gov" || len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Fatal("Invalid envelope:", msg.From, msg.To)
+	}
+}
+
+func TestServer_authenticatedUser(t *testing.T) {
+	users := make(chan string, 1)
+	rewrite := MailFromRewrite(func(state *ConnectionState, from string) (string, error) {
+		users <- state.AuthenticatedUser
+		return from, nil
+	})
+
+	_, s, c, scanner := testServerAuthenticated(t, rewrite.apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if user := <-users; user != "username" {
+		t.Fatal("Invalid authenticated user:", user)
+	}
+
+	_, s2, c2, scanner2, _ := testServerEhlo(t, rewrite.apply)
+	defer s2.Close()
+	defer c2.Close()
+
+	io.WriteString(c2, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner2.Scan()
+	if user := <-users; user != "" {
+		t.Fatal("Invalid authenticated user for anonymous client:", user)
+	}
+}
+
+func TestEnhancedCodes(t *testing.T) {
+	tests := []struct {
+		code EnhancedCode
+		want EnhancedCode
+	}{
+		{EnhancedCodeOK, EnhancedCode{2, 0, 0}},
+		{EnhancedCodeMailboxUnavailable, EnhancedCode{5, 1, 1}},
+		{EnhancedCodeMessageTooBig, EnhancedCode{5, 3, 4}},
+		{EnhancedCodeSyntaxError, EnhancedCode{5, 5, 2}},
+		{EnhancedCodeInvalidArguments, EnhancedCode{5, 5, 4}},
+		{EnhancedCodeTempSecurityError, EnhancedCode{4, 7, 0}},
+		{EnhancedCodeReverseDNSFailed, EnhancedCode{5, 7, 25}},
+		{ErrDataTooLarge.EnhancedCode, EnhancedCode{5, 3, 4}},
+	}
+	for _, test := range tests {
+		if test.code != test.want {
+			t.Errorf("Invalid enhanced code %v, want %v", test.code, test.want)
+		}
+	}
+
+	_, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "XXXX\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 5.5.2 ") {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+}
+
+type atrnBackend struct {
+	*backend
+	domains []string
+}
+
+func (be *atrnBackend) ATRN(_ *ConnectionState, domains []string) (func(conn net.Conn) error, error) {
+	be.domains = domains
+	if len(domains) == 1 && domains[0] == "empty.example" {
+		return nil, &SMTPError{Code: 453, EnhancedCode: EnhancedCodeTempFailure, Message: "You have no mail"}
+	}
+	return func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		if _, err := r.ReadString('\n'); err != nil {
+			return err
+		}
+		io.WriteString(conn, "QUIT\r\n")
+		_, err := r.ReadString('\n')
+		return err
+	}, nil
+}
+
+func TestParseAtrnDomains(t *testing.T) {
+	tests := []struct {
+		arg     string
+		domains []string
+		ok      bool
+	}{
+		{"", nil, true},
+		{"example.com", []string{"example.com"}, true},
+		{"Example.com, example.org", []string{"example.com", "example.org"}, true},
+		{"example.com,", nil, false},
+		{"example.com example.org", nil, false},
+	}
+	for _, test := range tests {
+		domains, ok := parseAtrnDomains(test.arg)
+		if ok != test.ok || strings.Join(domains, ",") != strings.Join(test.domains, ",") {
+			t.Errorf("parseAtrnDomains(%q) = %v, %v, want %v, %v", test.arg, domains, ok, test.domains, test.ok)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		arg    string
+		strict bool
+		addr   string
+		params string
+		ok     bool
+	}{
+		{"<root@nsa.gov>", true, "root@nsa.gov", "", true},
+		{" <root@nsa.gov> SIZE=1024  BODY=8BITMIME", true, "root@nsa.gov", "SIZE=1024,BODY=8BITMIME", true},
+		{"<>", true, "", "", true},
+		{`<"john doe"@example.com> SIZE=1`, true, `"john doe"@example.com`, "SIZE=1", true},
+		{`<"a\"> b"@example.com>`, true, `"a\"> b"@example.com`, "", true},
+		{"<@a,@b:user@c>", true, "user@c", "", true},
+		{"root@nsa.gov SIZE=1", false, "root@nsa.gov", "SIZE=1", true},
+		{"root@nsa.gov", true, "", "", false},
+		{"<root@nsa.gov", false, "", "", false},
+		{"<root@nsa.gov>SIZE=1", true, "", "", false},
+		{"<<root@nsa.gov>>", false, "", "", false},
+		{"<@a,@b>", true, "", "", false},
+	}
+	for _, test := range tests {
+		addr, params, err := parsePath(test.arg, test.strict)
+		if test.ok != (err == nil) || addr != test.addr || strings.Join(params, ",") != test.params {
+			t.Errorf("parsePath(%q, %v) = %q, %q, %v", test.arg, test.strict, addr, params, err)
+		}
+	}
+
+	if _, _, err := parseReversePath(" ", false); err == nil {
+		t.Error("parseReversePath accepted an empty path")
+	}
+	if _, _, err := parseForwardPath("<>", false); err == nil {
+		t.Error("parseForwardPath accepted the null path")
+	}
+}
+
+func TestServer_atrn(t *testing.T) {
+	var atrnBe *atrnBackend
+	withAtrn := func(s *Server) {
+		atrnBe = &atrnBackend{backend: s.backend.(*backend)}
+		s.backend = atrnBe
+		s.atrn = true
+	}
+
+	_, s, c, scanner, caps := testServerEhlo(t, withAtrn)
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["ATRN"] {
+		t.Fatal("ATRN capability is missing")
+	}
+
+	io.WriteString(c, "ATRN example.com\r\n")
+	scanner.Scan()
+	if scanner.Text() != "530 5.7.0 Authentication required" {
+		t.Fatal("Invalid ATRN response:", scanner.Text())
+	}
+
+	_, s, c, scanner = testServerAuthenticated(t, withAtrn)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "ATRN empty.example\r\n")
+	scanner.Scan()
+	if scanner.Text() != "453 4.0.0 You have no mail" {
+		t.Fatal("Invalid ATRN response:", scanner.Text())
+	}
+
+	io.WriteString(c, "ATRN example.com,Example.org\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 OK now reversing the connection" {
+		t.Fatal("Invalid ATRN response:", scanner.Text())
+	}
+	if strings.Join(atrnBe.domains, ",") != "example.com,example.org" {
+		t.Fatal("Invalid ATRN domains:", atrnBe.domains)
+	}
+
+	// The client is the server now
+	io.WriteString(c, "220 client.example.com ready\r\n")
+	scanner.Scan()
+	if scanner.Text() != "QUIT" {
+		t.Fatal("Invalid command from server:", scanner.Text())
+	}
+	io.WriteString(c, "221 Bye\r\n")
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+}
+
+type etrnBackend struct {
+	*backend
+	nodes []string
+}
+
+func (be *etrnBackend) ETRN(_ *ConnectionState, node string) error {
+	be.nodes = append(be.nodes, node)
+	switch node {
+	case "empty.example":
+		return &SMTPError{Code: 251, EnhancedCode: EnhancedCodeOK, Message: "OK, no messages waiting for node empty.example"}
+	case "@forbidden.example":
+		return &SMTPError{Code: 459, EnhancedCode: EnhancedCode{4, 7, 1}, Message: "Node @forbidden.example not allowed"}
+	case "broken.example":
+		return errors.New("queue runner crashed")
+	}
+	return nil
+}
+
+func TestServer_etrn(t *testing.T) {
+	var etrnBe *etrnBackend
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *Server) {
+		etrnBe = &etrnBackend{backend: s.backend.(*backend)}
+		s.backend = etrnBe
+		EnableETRN().apply(s)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["ETRN"] {
+		t.Fatal("ETRN capability is missing")
+	}
+
+	for _, tc := range []struct {
+		arg, resp string
+	}{
+		{"Example.ORG", "250 2.0.0 OK, queuing for node example.org started"},
+		{"#Queue1", "250 2.0.0 OK, queuing for node #Queue1 started"},
+		{"empty.example", "251 2.0.0 OK, no messages waiting for node empty.example"},
+		{"@forbidden.example", "459 4.7.1 Node @forbidden.example not allowed"},
+		{"broken.example", "458 4.0.0 Unable to queue messages for node broken.example"},
+		{"", "501 5.5.4 Was expecting ETRN arg syntax of [@|#]node"},
+		{"@#example.org", "501 5.5.4 Was expecting ETRN arg syntax of [@|#]node"},
+		{"example.org example.net", "501 5.5.4 Was expecting ETRN arg syntax of [@|#]node"},
+	} {
+		io.WriteString(c, strings.TrimSpace("ETRN "+tc.arg)+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.resp {
+			t.Errorf("ETRN %v: invalid response %q, want %q", tc.arg, scanner.Text(), tc.resp)
+		}
+	}
+
+	if len(etrnBe.nodes) != 5 || etrnBe.nodes[0] != "example.org" {
+		t.Fatal("Invalid nodes passed to the backend:", etrnBe.nodes)
+	}
+}
+
+// memAddr is the address of a memListener connection.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+// memListener is an in-memory net.Listener, connections are created with
+// dial.
+type memListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newMemListener() *memListener {
+	return &memListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return memAddr("memory") }
+
+func (l *memListener) dial(remote string) net.Conn {
+	server, client := net.Pipe()
+	l.conns <- &memConn{Conn: server, remote: memAddr(remote)}
+	return client
+}
+
+func TestServer_memListener(t *testing.T) {
+	be := &backend{}
+	s := NewServer(be, Domain("localhost"), ReadTimeout(10*time.Second), EnableReverseDNS())
+	s.resolver = stubResolver{"192.0.2.1": {"client.example.org."}}
+
+	l := newMemListener()
+	go s.Serve(l)
+	defer s.Close()
+
+	c := l.dial("192.0.2.1:4711")
+	defer c.Close()
+	scanner := bufio.NewScanner(c)
 
-	go s.Serve(l)
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
 
-	c, err = net.Dial("tcp", l.Addr().String())
-	if err != nil {
-		t.Fatal(err)
+	for _, cmd := range []string{"HELO localhost", "MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>", "DATA"} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") && !strings.HasPrefix(scanner.Text(), "354 ") {
+			t.Fatalf("Invalid response to %v: %v", cmd, scanner.Text())
+		}
+	}
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
 
-	scanner = bufio.NewScanner(c)
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+	if received := be.anonmsgs[0].Received; !strings.Contains(received, "(client.example.org [192.0.2.1])") {
+		t.Fatal("Invalid Received header:", received)
+	}
+}
+
+func TestServer_serveConn(t *testing.T) {
+	s := NewServer(&backend{}, Domain("localhost"))
+
+	server, c := net.Pipe()
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.ServeConn(&memConn{Conn: server, remote: memAddr("192.0.2.1:4711")})
+	}()
+	scanner := bufio.NewScanner(c)
 
 	scanner.Scan()
-	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
 		t.Fatal("Invalid greeting:", scanner.Text())
 	}
 
-	io.WriteString(c, "EHLO localhost\r\n")
+	var conns int
+	s.ForEachConn(func(*Conn) {
+		conns++
+	})
+	if conns != 1 {
+		t.Fatalf("Invalid number of connections: %v, want 1", conns)
+	}
 
-	scanner.Scan()
-	if scanner.Text() != "250-Hello localhost" {
-		t.Fatal("Invalid EHLO response:", scanner.Text())
+	s.Close()
+	if err := <-done; err != nil {
+		t.Fatal("ServeConn:", err)
 	}
 
-	expectedCaps := []string{"PIPELINING", "8BITMIME"}
-	caps := make(map[string]bool)
+	// Connections served after Close are closed immediately
+	server, c = net.Pipe()
+	defer c.Close()
+	if err := s.ServeConn(server); err != ErrServerClosed {
+		t.Fatal("ServeConn:", err)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Expected closed connection, got:", err)
+	}
+}
 
-	for scanner.Scan() {
-		s := scanner.Text()
+type limitBackend struct {
+	*backend
+	users []string
+}
 
-		if strings.HasPrefix(s, "250 ") {
-			caps[strings.TrimPrefix(s, "250 ")] = true
-			break
-		} else {
-			if !strings.HasPrefix(s, "250-") {
-				t.Fatal("Invalid capability response:", s)
-			}
-			caps[strings.TrimPrefix(s, "250-")] = true
-		}
+func (be *limitBackend) CheckSendLimit(state *ConnectionState, from string) error {
+	be.users = append(be.users, state.AuthenticatedUser)
+	if from == "spammer@example.org" {
+		return &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 7, 1}, Message: "Quota exceeded"}
 	}
+	return nil
+}
 
-	for _, cap := range expectedCaps {
-		if !caps[cap] {
-			t.Fatal("Missing capability:", cap)
-		}
+func (be *limitBackend) CheckRecipientLimit(state *ConnectionState, from, to string, count int) error {
+	if count >= 1 {
+		return &SMTPError{Code: 452, EnhancedCode: EnhancedCode{4, 5, 3}, Message: "Too many recipients for " + state.AuthenticatedUser}
 	}
-
-	return
+	return nil
 }
 
-func TestStrictServerGood(t *testing.T) {
-	s, c, scanner := testStrictServer(t)
+func TestServer_sendLimiter(t *testing.T) {
+	var limitBe *limitBackend
+	_, s, c, scanner := testServerAuthenticated(t, func(s *Server) {
+		limitBe = &limitBackend{backend: s.backend.(*backend)}
+		s.backend = limitBe
+	})
 	defer s.Close()
 	defer c.Close()
 
+	io.WriteString(c, "MAIL FROM:<spammer@example.org>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.7.1 Quota exceeded" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
 	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
 		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "452 4.5.3 Too many recipients for username" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	if len(limitBe.users) != 2 || limitBe.users[1] != "username" {
+		t.Errorf("Invalid users passed to CheckSendLimit: %v", limitBe.users)
+	}
 }
 
-func TestStrictServerBad(t *testing.T) {
-	s, c, scanner := testStrictServer(t)
+type sizeBackend struct {
+	*backend
+	sizes []int64
+}
+
+func (be *sizeBackend) CheckSize(state *ConnectionState, from string, size int64) error {
+	be.sizes = append(be.sizes, size)
+	if size > 1000 {
+		return ErrInsufficientStorage
+	}
+	return nil
+}
+
+func TestServer_sizeChecker(t *testing.T) {
+	var sizeBe *sizeBackend
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		sizeBe = &sizeBackend{backend: s.backend.(*backend)}
+		s.backend = sizeBe
+		MaxMessageBytes(0).apply(s)
+	})
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> SIZE=2000\r\n")
 	scanner.Scan()
-	if strings.HasPrefix(scanner.Text(), "250 ") {
+	if scanner.Text() != "452 4.3.1 Insufficient system storage" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	for _, arg := range []string{" SIZE=0", "", " SIZE=100"} {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>"+arg+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid MAIL response:", scanner.Text())
+		}
+		io.WriteString(c, "RSET\r\n")
+		scanner.Scan()
+	}
+
+	if len(sizeBe.sizes) != 2 || sizeBe.sizes[1] != 100 {
+		t.Errorf("Invalid sizes passed to CheckSize: %v", sizeBe.sizes)
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> SIZE=-1\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
 		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
 }
 
-func TestServer_lmtpOK(t *testing.T) {
-	be, s, c, scanner := testServerGreeted(t, func(s *Server) {
-		s.lmtp = true
-	})
+func TestServer_transaction(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t)
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "LHLO localhost\r\n")
+	transaction := func() Transaction {
+		var tr Transaction
+		s.ForEachConn(func(conn *Conn) {
+			tr = conn.Transaction()
+		})
+		return tr
+	}
 
+	if tr := transaction(); tr.FromReceived || tr.From != "" || len(tr.Recipients) != 0 {
+		t.Fatal("Invalid transaction before MAIL:", tr)
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	if scanner.Text() != "250-Hello localhost" {
-		t.Fatal("Invalid LHLO response:", scanner.Text())
+	io.WriteString(c, "RCPT TO:<Root@GCHQ.gov.uk>\r\n")
+	scanner.Scan()
+
+	tr := transaction()
+	if !tr.FromReceived || tr.From != "root@nsa.gov" || len(tr.Recipients) != 1 || tr.Recipients[0] != "root@gchq.gov.uk" {
+		t.Fatal("Invalid transaction:", tr)
 	}
+	tr.Recipients[0] = "changed"
 
-	for scanner.Scan() {
-		s := scanner.Text()
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if tr := transaction(); tr.FromReceived || len(tr.Recipients) != 0 {
+		t.Fatal("Invalid transaction after RSET:", tr)
+	}
+}
 
-		if strings.HasPrefix(s, "250 ") {
-			break
-		} else if !strings.HasPrefix(s, "250-") {
-			t.Fatal("Invalid capability response:", s)
+func TestServer_maxNoopCommands(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, MaxNoopCommands(3).apply)
+	defer s.Close()
+	defer c.Close()
+
+	// EHLO is the first command without progress
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+
+	// An accepted message resets the count
+	sendTestMail(t, c, scanner)
+	for i := 0; i < 3; i++ {
+		io.WriteString(c, "NOOP\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid NOOP response:", scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if scanner.Text() != "421 4.7.0 Too many commands without progress, closing connection" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+}
+
+type heloBackend struct {
+	*backend
+}
+
+func (be *heloBackend) CheckHELO(state *ConnectionState, name string) error {
+	if net.ParseIP(strings.Trim(name, "[]")) != nil {
+		return &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 7, 1}, Message: "Invalid HELO"}
+	}
+	return nil
+}
+
+func TestServer_checkHELO(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *Server) {
+		s.backend = &heloBackend{backend: s.backend.(*backend)}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, cmd := range []string{"HELO", "EHLO"} {
+		io.WriteString(c, cmd+" [192.0.2.1]\r\n")
+		scanner.Scan()
+		if scanner.Text() != "550 5.7.1 Invalid HELO" {
+			t.Fatalf("Invalid %v response: %v", cmd, scanner.Text())
 		}
 	}
 
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "HELO client.example.org\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid HELO response:", scanner.Text())
+	}
+}
+
+func TestServer_recipientResults(t *testing.T) {
+	var results map[string]*SMTPError
+	be, s, c, scanner := testServerAuthenticated(t, OnRecipientResults(func(_ *ConnectionState, r map[string]*SMTPError) {
+		results = r
+	}).apply)
+	defer s.Close()
+	defer c.Close()
+
+	be.recipientResults = true
+
 	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
 	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
@@ -635,28 +4389,160 @@ func TestServer_lmtpOK(t *testing.T) {
 	scanner.Scan()
 	io.WriteString(c, "DATA\r\n")
 	scanner.Scan()
-	io.WriteString(c, "Hey <3\r\n")
-	io.WriteString(c, ".\r\n")
+	io.WriteString(c, "Hey <3\r\n.\r\n")
 	scanner.Scan()
-	rcpt1 := scanner.Text()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(results) != 2 || results["root@gchq.gov.uk"] != nil {
+		t.Fatal("Invalid recipient results:", results)
+	}
+	if status := results["root@bnd.bund.de"]; status == nil || status.Code != 550 {
+		t.Fatal("Invalid result for root@bnd.bund.de:", status)
+	}
+}
+
+func TestServer_deduplicateRecipients(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, DeduplicateRecipients().apply, MaxRecipients(2).apply)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	rcpt2 := scanner.Text()
-	if !strings.HasPrefix(rcpt1, "250 ") {
-		t.Fatal("Invalid DATA first response:", scanner.Text())
+	for _, tc := range []struct {
+		rcpt, resp string
+	}{
+		{"root@gchq.gov.uk", "250 2.0.0 I'll make sure <root@gchq.gov.uk> gets this"},
+		{"root@GCHQ.gov.uk", "250 2.0.0 Duplicate recipient <root@GCHQ.gov.uk> ignored"},
+		{"Root@gchq.gov.uk", "250 2.0.0 I'll make sure <Root@gchq.gov.uk> gets this"},
+		{"root@gchq.gov.uk", "250 2.0.0 Duplicate recipient <root@gchq.gov.uk> ignored"},
+	} {
+		io.WriteString(c, "RCPT TO:<"+tc.rcpt+">\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.resp {
+			t.Fatalf("RCPT %v: invalid response %q, want %q", tc.rcpt, scanner.Text(), tc.resp)
+		}
 	}
-	if !strings.HasPrefix(rcpt1, "250 ") {
-		t.Fatal("Invalid DATA second response:", scanner.Text())
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
 
-	if rcpt1 != "250 2.0.0 <root@gchq.gov.uk> Finished" {
-		t.Fatal("Invalid responce:", rcpt1)
+	if len(be.messages) != 1 || len(be.messages[0].To) != 2 {
+		t.Fatal("Invalid recipients:", be.messages)
 	}
+}
 
-	if rcpt2 != "250 2.0.0 <root@bnd.bund.de> Finished" {
-		t.Fatal("Invalid responce:", rcpt2)
+func TestServer_bufferSizes(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, BufferSizes(64*1024, 100).apply)
+	defer s.Close()
+	defer c.Close()
+
+	var conn *Conn
+	s.ForEachConn(func(c *Conn) {
+		conn = c
+	})
+	if size := conn.text.R.Size(); size != 64*1024 {
+		t.Errorf("Invalid read buffer size: %v, want %v", size, 64*1024)
+	}
+	if size := conn.text.W.Size(); size != 4096 {
+		t.Errorf("Invalid write buffer size: %v, want the default", size)
 	}
 
-	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	sendTestMail(t, c, scanner)
+
+	_, s, c, _, _ = testServerEhlo(t, BufferSizes(0, 64*1024).apply)
+	defer s.Close()
+	defer c.Close()
+
+	s.ForEachConn(func(c *Conn) {
+		conn = c
+	})
+	if size := conn.text.R.Size(); size != 4096 {
+		t.Errorf("Invalid read buffer size: %v, want the default", size)
+	}
+	if size := conn.text.W.Size(); size != 64*1024 {
+		t.Errorf("Invalid write buffer size: %v, want %v", size, 64*1024)
+	}
+}
+
+type availabilityBackend struct {
+	*backend
+	err error
+}
+
+func (be *availabilityBackend) Available(_ *ConnectionState) error {
+	return be.err
+}
+
+func TestServer_available(t *testing.T) {
+	var availBe *availabilityBackend
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *Server) {
+		availBe = &availabilityBackend{backend: s.backend.(*backend)}
+		s.backend = availBe
+	})
+	defer s.Close()
+	defer c.Close()
+
+	sendTestMail(t, c, scanner)
+
+	availBe.err = &SMTPError{Code: 451, EnhancedCode: EnhancedCodeTempSystemError, Message: "Queue full", RetryAfter: time.Minute}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "451 4.3.0 Queue full, try again in 60s" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	availBe.err = &SMTPError{Code: 421, EnhancedCode: EnhancedCodeTempSystemError, Message: "Overloaded"}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "421 4.3.0 Overloaded" {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+}
+
+type connectionBackend struct {
+	*backend
+	blocked string
+}
+
+func (be *connectionBackend) CheckConnection(state *ConnectionState) error {
+	if addrIP(state.RemoteAddr).String() == be.blocked {
+		return &SMTPError{Code: 554, EnhancedCode: EnhancedCodeNotAuthorized, Message: "No SMTP service here"}
+	}
+	return nil
+}
+
+func TestServer_checkConnection(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *Server) {
+		s.backend = &connectionBackend{backend: s.backend.(*backend), blocked: "127.0.0.1"}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "554 5.7.1 No SMTP service here" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed:", scanner.Text())
+	}
+
+	_, s, c, scanner = testServer(t, func(s *Server) {
+		s.backend = &connectionBackend{backend: s.backend.(*backend), blocked: "192.0.2.1"}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid greeting:", scanner.Text())
 	}
 }
@@ -5,6 +5,7 @@
 package smtpclient
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -12,12 +13,17 @@ import (
 	"io"
 	"net"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-sasl"
+	"github.com/mschneider82/go-smtp"
 )
 
-// A Client represents a client connection to an SMTP server.
+// A Client represents a client connection to an SMTP server. Error replies
+// of the server are returned as *smtp.SMTPError, with the enhanced status
+// code split off the message.
 type Client struct {
 	// Text is the textproto.Conn used by the Client. It is exported to allow for
 	// clients to add extensions.
@@ -32,17 +38,31 @@ type Client struct {
 	// map of supported extensions
 	ext map[string]string
 	// supported auth mechanisms
-	auth        []string
-	localName   string // the name to use in HELO/EHLO/LHLO
-	didHello    bool   // whether we've said HELO/EHLO/LHLO
-	helloError  error  // the error from the hello
-	rcptToCount int    // number of recipients
+	auth       []string
+	localName  string   // the name to use in HELO/EHLO/LHLO
+	didHello   bool     // whether we've said HELO/EHLO/LHLO
+	helloError error    // the error from the hello
+	rcpts      []string // recipients of the current transaction
+	maxSize    int      // the SIZE announced by the server, 0 if unknown
+	// whether authentication over an unencrypted connection is allowed
+	insecureAuth bool
+	poolAddr     string // the address of the Pool the Client belongs to
+
+	deadline     time.Time     // deadline of the connection, zero means unset
+	readTimeout  time.Duration // timeout for reading a response, 0 means unset
+	writeTimeout time.Duration // timeout for sending a command, 0 means unset
 }
 
 // Dial returns a new Client connected to an SMTP server at addr.
 // The addr must include a port, as in "mail.example.com:smtp".
 func Dial(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
+	return DialWithDialer(&net.Dialer{}, addr)
+}
+
+// DialWithDialer is like Dial, but uses the dialer d to connect. This allows
+// to set e.g. the connect timeout or the local address to send from.
+func DialWithDialer(d *net.Dialer, addr string) (*Client, error) {
+	conn, err := d.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -50,10 +70,19 @@ func Dial(addr string) (*Client, error) {
 	return NewClient(conn, host)
 }
 
-// DialTLS returns a new Client connected to an SMTP server via TLS at addr.
-// The addr must include a port, as in "mail.example.com:smtps".
+// DialTLS returns a new Client connected to an SMTP server via TLS at addr,
+// i.e. with implicit TLS as opposed to STARTTLS. The handshake is done before
+// the greeting is read, EHLO and all further commands are sent over the
+// encrypted channel. The addr must include a port, as in
+// "mail.example.com:smtps".
 func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
-	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	return DialTLSWithDialer(&net.Dialer{}, addr, tlsConfig)
+}
+
+// DialTLSWithDialer is like DialTLS, but uses the dialer d to connect. The
+// dialer's timeout also applies to the TLS handshake.
+func DialTLSWithDialer(d *net.Dialer, addr string, tlsConfig *tls.Config) (*Client, error) {
+	conn, err := tls.DialWithDialer(d, "tcp", addr, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -68,13 +97,30 @@ func NewClient(conn net.Conn, host string) (*Client, error) {
 	_, _, err := text.ReadResponse(220)
 	if err != nil {
 		text.Close()
-		return nil, err
+		return nil, toSMTPErr(err)
 	}
 	_, isTLS := conn.(*tls.Conn)
 	c := &Client{Text: text, conn: conn, serverName: host, localName: "localhost", tls: isTLS}
 	return c, nil
 }
 
+// DialLMTP returns a new LMTP Client connected to a server at addr. If addr
+// is an absolute path, a unix socket is used, otherwise addr must include a
+// port.
+func DialLMTP(addr string) (*Client, error) {
+	network, host := "tcp", "localhost"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	} else {
+		host, _, _ = net.SplitHostPort(addr)
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientLMTP(conn, host)
+}
+
 // NewClientLMTP returns a new LMTP Client (as defined in RFC 2033) using an
 // existing connector and host as a server name to be used when authenticating.
 func NewClientLMTP(conn net.Conn, host string) (*Client, error) {
@@ -96,9 +142,12 @@ func (c *Client) hello() error {
 	if !c.didHello {
 		c.didHello = true
 		err := c.ehlo()
-		if err != nil {
-			c.helloError = c.helo()
+		// Old servers reject EHLO with a permanent error, LMTP servers
+		// have no fallback
+		if smtpErr, ok := err.(*smtp.SMTPError); ok && smtpErr.Code/100 == 5 && !c.lmtp {
+			err = c.helo()
 		}
+		c.helloError = err
 	}
 	return c.helloError
 }
@@ -119,22 +168,130 @@ func (c *Client) Hello(localName string) error {
 	return c.hello()
 }
 
+// SetDeadline sets the read and write deadlines of the connection. Commands
+// failing to complete before t return a timeout error, after which the Client
+// should be closed. A zero value for t means no deadline.
+func (c *Client) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadTimeout sets the maximum time to wait for each response of the
+// server. A zero value means no timeout. It is bound by the deadline set
+// with SetDeadline.
+func (c *Client) SetReadTimeout(d time.Duration) {
+	c.readTimeout = d
+}
+
+// SetWriteTimeout sets the maximum time to send each command and each write
+// of the message body. A zero value means no timeout. It is bound by the
+// deadline set with SetDeadline.
+func (c *Client) SetWriteTimeout(d time.Duration) {
+	c.writeTimeout = d
+}
+
+// ioDeadline returns the deadline of an operation bound by timeout.
+func (c *Client) ioDeadline(timeout time.Duration) time.Time {
+	deadline := c.deadline
+	if t := time.Now().Add(timeout); deadline.IsZero() || t.Before(deadline) {
+		deadline = t
+	}
+	return deadline
+}
+
+// setReadDeadline applies the read timeout before a response is read.
+func (c *Client) setReadDeadline() error {
+	if c.readTimeout == 0 {
+		return nil
+	}
+	return c.conn.SetReadDeadline(c.ioDeadline(c.readTimeout))
+}
+
+// setWriteDeadline applies the write timeout before a command is sent.
+func (c *Client) setWriteDeadline() error {
+	if c.writeTimeout == 0 {
+		return nil
+	}
+	return c.conn.SetWriteDeadline(c.ioDeadline(c.writeTimeout))
+}
+
 // cmd is a convenience function that sends a command and returns the response
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	if err := c.setWriteDeadline(); err != nil {
+		return 0, "", err
+	}
 	id, err := c.Text.Cmd(format, args...)
 	if err != nil {
 		return 0, "", err
 	}
 	c.Text.StartResponse(id)
 	defer c.Text.EndResponse(id)
+	if err := c.setReadDeadline(); err != nil {
+		return 0, "", err
+	}
 	code, msg, err := c.Text.ReadResponse(expectCode)
-	return code, msg, err
+	return code, msg, toSMTPErr(err)
+}
+
+// toSMTPErr converts a *textproto.Error response of the server to an
+// *smtp.SMTPError, other errors are returned unchanged. The enhanced status
+// code (RFC 2034) is split off the lines of the response, it is set to
+// smtp.NoEnhancedCode if the server didn't send one.
+func toSMTPErr(err error) error {
+	protoErr, ok := err.(*textproto.Error)
+	if !ok {
+		return err
+	}
+
+	smtpErr := &smtp.SMTPError{
+		Code:         protoErr.Code,
+		EnhancedCode: smtp.NoEnhancedCode,
+		Message:      protoErr.Msg,
+	}
+
+	lines := strings.Split(protoErr.Msg, "\n")
+	parts := strings.SplitN(lines[0], " ", 2)
+	enhancedCode, ok := parseEnhancedCode(parts[0])
+	if !ok || enhancedCode[0] != protoErr.Code/100 {
+		return smtpErr
+	}
+	smtpErr.EnhancedCode = enhancedCode
+
+	prefix := parts[0] + " "
+	for i, line := range lines {
+		if line == parts[0] {
+			lines[i] = ""
+		} else {
+			lines[i] = strings.TrimPrefix(line, prefix)
+		}
+	}
+	smtpErr.Message = strings.Join(lines, "\n")
+	return smtpErr
+}
+
+// parseEnhancedCode parses an enhanced status code of the form "X.Y.Z".
+func parseEnhancedCode(s string) (smtp.EnhancedCode, bool) {
+	var code smtp.EnhancedCode
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return code, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 999 {
+			return code, false
+		}
+		code[i] = n
+	}
+	return code, true
 }
 
 // helo sends the HELO greeting to the server. It should be used only when the
 // server does not support ehlo.
 func (c *Client) helo() error {
 	c.ext = nil
+	c.auth = nil
+	c.maxSize = 0
 	_, _, err := c.cmd(250, "HELO %s", c.localName)
 	return err
 }
@@ -155,16 +312,21 @@ func (c *Client) ehlo() error {
 	if len(extList) > 1 {
 		extList = extList[1:]
 		for _, line := range extList {
-			args := strings.SplitN(line, " ", 2)
+			args := strings.SplitN(strings.TrimSpace(line), " ", 2)
+			keyword := strings.ToUpper(args[0])
 			if len(args) > 1 {
-				ext[args[0]] = args[1]
+				ext[keyword] = strings.TrimSpace(args[1])
 			} else {
-				ext[args[0]] = ""
+				ext[keyword] = ""
 			}
 		}
 	}
 	if mechs, ok := ext["AUTH"]; ok {
-		c.auth = strings.Split(mechs, " ")
+		c.auth = strings.Fields(mechs)
+	}
+	c.maxSize = 0
+	if size, err := strconv.Atoi(ext["SIZE"]); err == nil && size > 0 {
+		c.maxSize = size
 	}
 	c.ext = ext
 	return err
@@ -209,9 +371,10 @@ func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 }
 
 // Verify checks the validity of an email address on the server.
-// If Verify returns nil, the address is valid. A non-nil return
-// does not necessarily indicate an invalid address. Many servers
-// will not verify addresses for security reasons.
+// If Verify returns nil, the address is valid (250 or 251 response). A
+// non-nil return does not necessarily indicate an invalid address. Many
+// servers will not verify addresses for security reasons and reply with
+// 252. Server responses are returned as *smtp.SMTPError.
 func (c *Client) Verify(addr string) error {
 	if err := validateLine(addr); err != nil {
 		return err
@@ -219,23 +382,59 @@ func (c *Client) Verify(addr string) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
-	_, _, err := c.cmd(250, "VRFY %s", addr)
+	code, msg, err := c.cmd(25, "VRFY %s", addr)
+	if err == nil && code != 250 && code != 251 {
+		err = toSMTPErr(&textproto.Error{Code: code, Msg: msg})
+	}
 	return err
 }
 
+// AllowInsecureAuth allows Auth to send credentials over an unencrypted
+// connection. By default this is only allowed if the server is localhost.
+func (c *Client) AllowInsecureAuth(allow bool) {
+	c.insecureAuth = allow
+}
+
+// SupportsAuth reports whether the server advertised the authentication
+// mechanism mech.
+func (c *Client) SupportsAuth(mech string) bool {
+	if err := c.hello(); err != nil {
+		return false
+	}
+	for _, m := range c.auth {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
 // Auth authenticates a client using the provided authentication mechanism.
 // A failed authentication closes the connection.
-// Only servers that advertise the AUTH extension support this function.
+// Only servers that advertise the AUTH extension support this function. The
+// mechanism must be advertised by the server and the connection must be
+// encrypted, unless AllowInsecureAuth was called or the server is localhost.
 func (c *Client) Auth(a sasl.Client) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
+	if !c.tls && !c.insecureAuth && !isLocalhost(c.serverName) {
+		return errors.New("smtp: refusing to authenticate over an unencrypted connection")
+	}
 	encoding := base64.StdEncoding
 	mech, resp, err := a.Start()
 	if err != nil {
 		c.Quit()
 		return err
 	}
+	if c.ext != nil {
+		if _, ok := c.ext["AUTH"]; !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+		if !c.SupportsAuth(mech) {
+			return fmt.Errorf("smtp: server doesn't support AUTH mechanism %s", mech)
+		}
+	}
 	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
 	encoding.Encode(resp64, resp)
 	code, msg64, err := c.cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
@@ -248,7 +447,7 @@ func (c *Client) Auth(a sasl.Client) error {
 			// the last message isn't base64 because it isn't a challenge
 			msg = []byte(msg64)
 		default:
-			err = &textproto.Error{Code: code, Msg: msg64}
+			err = toSMTPErr(&textproto.Error{Code: code, Msg: msg64})
 		}
 		if err == nil {
 			if code == 334 {
@@ -290,8 +489,11 @@ func (c *Client) Mail(from string) error {
 			cmdStr += " BODY=8BITMIME"
 		}
 	}
-	_, _, err := c.cmd(250, cmdStr, from)
-	return err
+	if _, _, err := c.cmd(250, cmdStr, from); err != nil {
+		return err
+	}
+	c.rcpts = nil
+	return nil
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
@@ -304,41 +506,86 @@ func (c *Client) Rcpt(to string) error {
 	if _, _, err := c.cmd(25, "RCPT TO:<%s>", to); err != nil {
 		return err
 	}
-	c.rcptToCount++
+	c.rcpts = append(c.rcpts, to)
 	return nil
 }
 
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
+	statusCb func(rcpt string, status *smtp.SMTPError)
+}
+
+func (d *dataCloser) Write(b []byte) (int, error) {
+	if err := d.c.setWriteDeadline(); err != nil {
+		return 0, err
+	}
+	return d.WriteCloser.Write(b)
 }
 
 func (d *dataCloser) Close() error {
+	if err := d.c.setWriteDeadline(); err != nil {
+		return err
+	}
 	d.WriteCloser.Close()
-	if d.c.lmtp {
-		for d.c.rcptToCount > 0 {
-			if _, _, err := d.c.Text.ReadResponse(250); err != nil {
-				return err
-			}
-			d.c.rcptToCount--
+	rcpts := d.c.rcpts
+	d.c.rcpts = nil
+	if !d.c.lmtp {
+		if err := d.c.setReadDeadline(); err != nil {
+			return err
 		}
-		return nil
-	} else {
 		_, _, err := d.c.Text.ReadResponse(250)
-		return err
+		return toSMTPErr(err)
 	}
+
+	// LMTP servers reply with one status per recipient, all of them have
+	// to be read to keep the connection in sync.
+	var firstErr error
+	for _, rcpt := range rcpts {
+		if err := d.c.setReadDeadline(); err != nil {
+			return err
+		}
+		_, _, err := d.c.Text.ReadResponse(250)
+		if _, isStatus := err.(*textproto.Error); err != nil && !isStatus {
+			return err
+		}
+		var status *smtp.SMTPError
+		if err != nil {
+			status = toSMTPErr(err).(*smtp.SMTPError)
+		}
+		if d.statusCb != nil {
+			d.statusCb(rcpt, status)
+		}
+		if status != nil && firstErr == nil {
+			firstErr = status
+		}
+	}
+	return firstErr
 }
 
 // Data issues a DATA command to the server and returns a writer that
-// can be used to write the mail headers and body. The caller should
+// can be used to write the mail headers and body. The written data is
+// dot-stuffed and terminated when the writer is closed. The caller should
 // close the writer before calling any more methods on c. A call to
 // Data must be preceded by one or more calls to Rcpt.
+//
+// In LMTP mode, closing the writer returns the first error of the
+// per-recipient responses. Use LMTPData to get the status of every
+// recipient.
 func (c *Client) Data() (io.WriteCloser, error) {
+	return c.LMTPData(nil)
+}
+
+// LMTPData is like Data, but statusCb is called with the response of every
+// recipient when the writer is closed. The status is nil if the message was
+// delivered to the recipient. LMTPData can only be used with LMTP clients,
+// for SMTP clients statusCb is never called.
+func (c *Client) LMTPData(statusCb func(rcpt string, status *smtp.SMTPError)) (io.WriteCloser, error) {
 	_, _, err := c.cmd(354, "DATA")
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter()}, nil
+	return &dataCloser{c, c.Text.DotWriter(), statusCb}, nil
 }
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
@@ -364,24 +611,87 @@ var testHookStartTLS func(*tls.Config) // nil, except for tests
 // functionality. Higher-level packages exist outside of the standard
 // library.
 func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader) error {
-	if err := validateLine(from); err != nil {
+	return SendMailContext(context.Background(), addr, a, from, to, r)
+}
+
+// SendMailContext is like SendMail, but the deadline of ctx applies to the
+// dial and the whole SMTP session. If ctx is canceled, the connection is
+// closed and ctx.Err() is returned.
+func SendMailContext(ctx context.Context, addr string, a sasl.Client, from string, to []string, r io.Reader) error {
+	if err := validateAddrs(from, to); err != nil {
 		return err
 	}
-	for _, recp := range to {
-		if err := validateLine(recp); err != nil {
-			return err
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Abort the session if ctx is canceled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
 		}
+	}()
+
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := NewClient(conn, host)
+	if err == nil {
+		defer c.Close()
+		err = c.sendMail(a, from, to, r)
 	}
-	c, err := Dial(addr)
+	if err != nil {
+		if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+			// The conn deadline may expire before ctx is done
+			return context.DeadlineExceeded
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// SendMailTLS is like SendMail, but connects to addr with implicit TLS, as
+// DialTLS does.
+func SendMailTLS(addr string, tlsConfig *tls.Config, a sasl.Client, from string, to []string, r io.Reader) error {
+	if err := validateAddrs(from, to); err != nil {
+		return err
+	}
+	c, err := DialTLS(addr, tlsConfig)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
-	if err = c.hello(); err != nil {
+	return c.sendMail(a, from, to, r)
+}
+
+func validateAddrs(from string, to []string) error {
+	if err := validateLine(from); err != nil {
+		return err
+	}
+	for _, recp := range to {
+		if err := validateLine(recp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendMail runs the SMTP session of SendMail on c.
+func (c *Client) sendMail(a sasl.Client, from string, to []string, r io.Reader) error {
+	if err := c.hello(); err != nil {
 		return err
 	}
-	if ok, _ := c.Extension("STARTTLS"); ok {
-		if err = c.StartTLS(nil); err != nil {
+	if ok, _ := c.Extension("STARTTLS"); ok && !c.tls {
+		if err := c.StartTLS(nil); err != nil {
 			return err
 		}
 	}
@@ -389,15 +699,18 @@ func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader)
 		if _, ok := c.ext["AUTH"]; !ok {
 			return errors.New("smtp: server doesn't support AUTH")
 		}
-		if err = c.Auth(a); err != nil {
+		if err := c.Auth(a); err != nil {
 			return err
 		}
 	}
-	if err = c.Mail(from); err != nil {
+	if err := c.checkMessageSize(r); err != nil {
+		return err
+	}
+	if err := c.Mail(from); err != nil {
 		return err
 	}
 	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
+		if err := c.Rcpt(addr); err != nil {
 			return err
 		}
 	}
@@ -432,6 +745,29 @@ func (c *Client) Extension(ext string) (bool, string) {
 	return ok, param
 }
 
+// MaxMessageSize returns the maximum message size announced by the server
+// with the SIZE extension (RFC 1870). ok is false if the server doesn't
+// announce a fixed limit.
+func (c *Client) MaxMessageSize() (size int, ok bool) {
+	if err := c.hello(); err != nil {
+		return 0, false
+	}
+	return c.maxSize, c.maxSize > 0
+}
+
+// checkMessageSize fails if the size of r is known and exceeds the maximum
+// message size of the server.
+func (c *Client) checkMessageSize(r io.Reader) error {
+	lr, ok := r.(interface{ Len() int })
+	if !ok {
+		return nil
+	}
+	if max, ok := c.MaxMessageSize(); ok && lr.Len() > max {
+		return fmt.Errorf("smtp: message size of %d bytes exceeds the server limit of %d bytes", lr.Len(), max)
+	}
+	return nil
+}
+
 // Reset sends the RSET command to the server, aborting the current mail
 // transaction.
 func (c *Client) Reset() error {
@@ -441,7 +777,7 @@ func (c *Client) Reset() error {
 	if _, _, err := c.cmd(250, "RSET"); err != nil {
 		return err
 	}
-	c.rcptToCount = 0
+	c.rcpts = nil
 	return nil
 }
 
@@ -7,9 +7,12 @@ package smtpclient
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
 	"strings"
@@ -18,6 +21,7 @@ import (
 	"time"
 
 	"github.com/emersion/go-sasl"
+	"github.com/mschneider82/go-smtp"
 )
 
 // Issue 17794: don't send a trailing space on AUTH command when there's no password.
@@ -71,6 +75,28 @@ func (f faker) SetDeadline(time.Time) error      { return nil }
 func (f faker) SetReadDeadline(time.Time) error  { return nil }
 func (f faker) SetWriteDeadline(time.Time) error { return nil }
 
+func TestVerify(t *testing.T) {
+	server := "251 2.1.5 User not local; will forward to <root@example.org>\r\n" +
+		"252 2.5.0 Cannot VRFY user\r\n" +
+		"550 5.1.1 No such user\r\n"
+
+	var cmdbuf bytes.Buffer
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(&cmdbuf))
+	c := &Client{Text: textproto.NewConn(fake), didHello: true}
+
+	if err := c.Verify("root@example.com"); err != nil {
+		t.Fatalf("VRFY with 251 response failed: %s", err)
+	}
+	if err := c.Verify("root@example.com"); err == nil {
+		t.Fatalf("VRFY with 252 response should fail")
+	}
+	err := c.Verify("root@example.com")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) || smtpErr.Message != "No such user" {
+		t.Fatalf("Invalid VRFY error: %v", err)
+	}
+}
+
 func TestBasic(t *testing.T) {
 	server := strings.Join(strings.Split(basicServer, "\n"), "\r\n")
 	client := strings.Join(strings.Split(basicClient, "\n"), "\r\n")
@@ -244,6 +270,45 @@ var newClientClient = `EHLO localhost
 QUIT
 `
 
+func TestClientEhloExtensions(t *testing.T) {
+	server := strings.Join(strings.Split(ehloExtensionsServer, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(&cmdbuf))
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	want := map[string]string{
+		"PIPELINING": "",
+		"SIZE":       "35882577",
+		"AUTH":       "PLAIN LOGIN",
+		"STARTTLS":   "",
+	}
+	for ext, param := range want {
+		if ok, args := c.Extension(ext); !ok || args != param {
+			t.Errorf("Extension(%q) = %v, %q, want true, %q", ext, ok, args, param)
+		}
+	}
+	if size, ok := c.MaxMessageSize(); !ok || size != 35882577 {
+		t.Errorf("MaxMessageSize() = %v, %v, want 35882577, true", size, ok)
+	}
+	if len(c.auth) != 2 || c.auth[0] != "PLAIN" || c.auth[1] != "LOGIN" {
+		t.Errorf("Invalid AUTH mechanisms: %v", c.auth)
+	}
+}
+
+var ehloExtensionsServer = `220 hello world
+250-mx.example.org greets localhost
+250-PIPELINING
+250-size 35882577
+250-AUTH PLAIN LOGIN
+250 STARTTLS
+`
+
 func TestNewClient2(t *testing.T) {
 	server := strings.Join(strings.Split(newClient2Server, "\n"), "\r\n")
 	client := strings.Join(strings.Split(newClient2Client, "\n"), "\r\n")
@@ -271,6 +336,28 @@ func TestNewClient2(t *testing.T) {
 	}
 }
 
+func TestClientHelloNoFallback(t *testing.T) {
+	server := "220 hello world\r\n421 4.3.2 Too busy\r\n"
+
+	var cmdbuf bytes.Buffer
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bufio.NewWriter(&cmdbuf))
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	err = c.Hello("mx.example.org")
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 421 {
+		t.Fatalf("Hello: %v, want 421 error", err)
+	}
+	fake.ReadWriter.(*bufio.ReadWriter).Flush()
+	if cmdbuf.String() != "EHLO mx.example.org\r\n" {
+		t.Fatalf("Invalid commands: %q", cmdbuf.String())
+	}
+}
+
 var newClient2Server = `220 hello world
 502 EH?
 250-mx.google.com at your service
@@ -315,7 +402,7 @@ func TestHello(t *testing.T) {
 			err = c.Hello("customhost")
 		case 1:
 			err = c.StartTLS(nil)
-			if err.Error() == "502 Not implemented" {
+			if smtpErr, ok := err.(*smtp.SMTPError); ok && smtpErr.Code == 502 {
 				err = nil
 			}
 		case 2:
@@ -364,6 +451,7 @@ func TestHello(t *testing.T) {
 var baseHelloServer = `220 hello world
 502 EH?
 250-mx.google.com at your service
+250-AUTH PLAIN
 250 FEATURE
 `
 
@@ -542,6 +630,43 @@ SendMail is working for me.
 	wg.Wait()
 }
 
+func TestSendMailTooLarge(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 hello world")
+		if msg, _ := tc.ReadLine(); msg != "EHLO localhost" {
+			errc <- fmt.Errorf("unexpected command: %q", msg)
+			return
+		}
+		tc.PrintfLine("250-mx.google.com at your service")
+		tc.PrintfLine("250 SIZE 10")
+		// The client must not start a transaction
+		if msg, err := tc.ReadLine(); err != io.EOF {
+			errc <- fmt.Errorf("unexpected command: %q", msg)
+			return
+		}
+		errc <- nil
+	}()
+
+	err := SendMail(ln.Addr().String(), nil, "test@example.com", []string{"other@example.com"}, strings.NewReader("Subject: too large\r\n\r\n"))
+	if err == nil || err.Error() != "smtp: message size of 22 bytes exceeds the server limit of 10 bytes" {
+		t.Errorf("Expected message size error, got: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+}
+
 func TestAuthFailed(t *testing.T) {
 	server := strings.Join(strings.Split(authFailedServer, "\n"), "\r\n")
 	client := strings.Join(strings.Split(authFailedClient, "\n"), "\r\n")
@@ -561,7 +686,7 @@ func TestAuthFailed(t *testing.T) {
 
 	if err == nil {
 		t.Error("Auth: expected error; got none")
-	} else if err.Error() != "535 Invalid credentials\nplease see www.example.com" {
+	} else if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 535 || smtpErr.Message != "Invalid credentials\nplease see www.example.com" {
 		t.Errorf("Auth: got error: %v, want: %s", err, "535 Invalid credentials\nplease see www.example.com")
 	}
 
@@ -606,6 +731,34 @@ func TestTLSClient(t *testing.T) {
 	}
 }
 
+func TestSendMailTLS(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	errc := make(chan error)
+	go func() {
+		cfg := &tls.Config{ServerName: "example.com"}
+		testHookStartTLS(cfg) // set the RootCAs
+		errc <- SendMailTLS(ln.Addr().String(), cfg, nil, "joe1@example.com", []string{"joe2@example.com"}, strings.NewReader("Subject: test\n\nhowdy!"))
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept connection: %v", err)
+	}
+	keypair, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{keypair}})
+	defer conn.Close()
+	smtpSender{conn}.send("220 127.0.0.1 ESMTP service ready")
+	if err := serverHandleTLS(conn, t); err != nil {
+		t.Fatalf("failed to handle connection: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+}
+
 func TestTLSConnState(t *testing.T) {
 	ln := newLocalListener(t)
 	defer ln.Close()
@@ -850,3 +1003,334 @@ Goodbye.
 .
 QUIT
 `
+
+func TestLMTPData(t *testing.T) {
+	server := strings.Join(strings.Split(lmtpDataServer, "\n"), "\r\n")
+
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c := &Client{Text: textproto.NewConn(fake), lmtp: true, didHello: true}
+
+	if err := c.Mail("user@gmail.com"); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	rcpts := []string{"alice@example.com", "bob@example.com", "carol@example.com"}
+	for _, rcpt := range rcpts {
+		if err := c.Rcpt(rcpt); err != nil {
+			t.Fatalf("RCPT failed: %s", err)
+		}
+	}
+
+	statuses := make(map[string]*smtp.SMTPError)
+	w, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		statuses[rcpt] = status
+	})
+	if err != nil {
+		t.Fatalf("DATA failed: %s", err)
+	}
+	io.WriteString(w, "Subject: Hi\r\n\r\nHello\r\n")
+	err = w.Close()
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 550 {
+		t.Fatalf("Expected 550 error, got: %v", err)
+	}
+
+	if len(statuses) != 3 || statuses["alice@example.com"] != nil || statuses["carol@example.com"] != nil {
+		t.Fatalf("Invalid statuses: %v", statuses)
+	}
+	if status := statuses["bob@example.com"]; status == nil || status.Code != 550 || status.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) || status.Message != "No such user" {
+		t.Fatalf("Invalid status for bob: %v", status)
+	}
+
+	// The connection is still in sync
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %s", err)
+	}
+}
+
+var lmtpDataServer = `250 Sender OK
+250 Receiver OK
+250 Receiver OK
+250 Receiver OK
+354 Go ahead
+250 2.0.0 Delivered
+550 5.1.1 No such user
+250 2.0.0 Delivered
+221 OK
+`
+
+func TestDotWriter(t *testing.T) {
+	body := "Line 1\r\n.\r\n.Line 3\nLine 4"
+	var buf bytes.Buffer
+	w := textproto.NewWriter(bufio.NewWriter(&buf)).DotWriter()
+	if _, err := io.WriteString(w, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Line 1\r\n..\r\n..Line 3\r\nLine 4\r\n.\r\n"
+	if buf.String() != want {
+		t.Fatalf("Got:\n%q\nExpected:\n%q", buf.String(), want)
+	}
+
+	// the encoded body must survive the server's dot decoding
+	r := smtp.NewReader(bufio.NewReader(&buf))
+	b, err := ioutil.ReadAll(r.DotReader2())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "Line 1\r\n.\r\n.Line 3\r\nLine 4\r\n" {
+		t.Fatalf("Invalid round trip: %q", b)
+	}
+}
+
+func TestAuthNegotiation(t *testing.T) {
+	server := strings.Join(strings.Split(`220 hello world
+250-mx.google.com at your service
+250 AUTH LOGIN
+`, "\n"), "\r\n")
+	var cmdbuf bytes.Buffer
+	bcmdbuf := bufio.NewWriter(&cmdbuf)
+	var fake faker
+	fake.ReadWriter = bufio.NewReadWriter(bufio.NewReader(strings.NewReader(server)), bcmdbuf)
+	c, err := NewClient(fake, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Auth(sasl.NewPlainClient("", "user", "pass")); err == nil {
+		t.Error("Auth over an unencrypted connection should fail")
+	}
+
+	c.AllowInsecureAuth(true)
+	if !c.SupportsAuth("login") || c.SupportsAuth("PLAIN") {
+		t.Errorf("Invalid supported auth mechanisms: %v", c.auth)
+	}
+	if err := c.Auth(sasl.NewPlainClient("", "user", "pass")); err == nil {
+		t.Error("Auth with an unsupported mechanism should fail")
+	}
+
+	bcmdbuf.Flush()
+	if cmds := cmdbuf.String(); cmds != "EHLO localhost\r\n" {
+		t.Errorf("Got:\n%s\nExpected:\nEHLO localhost", cmds)
+	}
+}
+
+func TestSendMailContext(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	// The server accepts connections, but never greets
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := SendMailContext(ctx, ln.Addr().String(), nil, "test@example.com", []string{"other@example.com"}, strings.NewReader("Subject: test\r\n\r\n"))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- SendMailContext(ctx, ln.Addr().String(), nil, "test@example.com", []string{"other@example.com"}, strings.NewReader("Subject: test\r\n\r\n"))
+	}()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendMailContext didn't abort on cancellation")
+	}
+}
+
+func TestPool(t *testing.T) {
+	var dials int
+	var cmds []*bytes.Buffer
+	p := &Pool{
+		Dial: func(addr string) (*Client, error) {
+			dials++
+			server := "220 hello world\r\n250 hello\r\n250 2.0.0 OK\r\n421 4.4.2 Idle too long\r\n"
+			cmdbuf := &bytes.Buffer{}
+			cmds = append(cmds, cmdbuf)
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(server), cmdbuf}
+			return NewClient(fake, "fake.host")
+		},
+	}
+	defer p.Close()
+
+	c, err := p.Get("mx.example.org:25")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	p.Put(c)
+
+	// The idle connection is checked with RSET and reused
+	c, err = p.Get("mx.example.org:25")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if dials != 1 {
+		t.Fatalf("Connection not reused, %v dials", dials)
+	}
+	if cmds[0].String() != "EHLO localhost\r\nRSET\r\n" {
+		t.Fatalf("Invalid commands: %q", cmds[0].String())
+	}
+	p.Put(c)
+
+	// The stale connection fails RSET and is replaced
+	if _, err := p.Get("mx.example.org:25"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if dials != 2 {
+		t.Fatalf("Stale connection reused, %v dials", dials)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	var dials int
+	p := &Pool{
+		Dial: func(addr string) (*Client, error) {
+			dials++
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader("220 hello world\r\n"), ioutil.Discard}
+			return NewClient(fake, "fake.host")
+		},
+		MaxIdlePerHost: 1,
+		IdleTimeout:    time.Millisecond,
+	}
+	defer p.Close()
+
+	c1, _ := p.Get("mx.example.org:25")
+	c2, _ := p.Get("mx.example.org:25")
+	p.Put(c1)
+	p.Put(c2)
+	if n := len(p.idle["mx.example.org:25"]); n != 1 {
+		t.Fatalf("Invalid number of idle connections: %v, want 1", n)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := p.Get("mx.example.org:25"); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if dials != 3 {
+		t.Fatalf("Expired connection reused, %v dials", dials)
+	}
+}
+
+func TestClientTimeouts(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		io.WriteString(serverConn, "220 hello world\r\n")
+		// Read commands, but never answer
+		io.Copy(ioutil.Discard, serverConn)
+	}()
+
+	c, err := NewClient(clientConn, "fake.host")
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	c.SetReadTimeout(50 * time.Millisecond)
+	start := time.Now()
+	err = c.Noop()
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Timeout took %v", d)
+	}
+
+	c.SetReadTimeout(time.Minute)
+	if err := c.SetDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatalf("SetDeadline: %v", err)
+	}
+	err = c.Noop()
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("Expected timeout error with deadline, got %v", err)
+	}
+}
+
+func TestToSMTPErr(t *testing.T) {
+	tests := []struct {
+		code    int
+		msg     string
+		enhCode smtp.EnhancedCode
+		want    string
+	}{
+		{550, "5.1.1 No such user", smtp.EnhancedCode{5, 1, 1}, "No such user"},
+		{452, "4.3.1 Insufficient storage\n4.3.1 try again later", smtp.EnhancedCode{4, 3, 1}, "Insufficient storage\ntry again later"},
+		{554, "Transaction failed", smtp.NoEnhancedCode, "Transaction failed"},
+		// The class of the enhanced code has to match the reply code
+		{554, "2.0.0 Weird", smtp.NoEnhancedCode, "2.0.0 Weird"},
+		{421, "4.4.2", smtp.EnhancedCode{4, 4, 2}, ""},
+	}
+	for _, tc := range tests {
+		err := toSMTPErr(&textproto.Error{Code: tc.code, Msg: tc.msg})
+		smtpErr, ok := err.(*smtp.SMTPError)
+		if !ok {
+			t.Fatalf("toSMTPErr(%q) = %T, want *smtp.SMTPError", tc.msg, err)
+		}
+		if smtpErr.Code != tc.code || smtpErr.EnhancedCode != tc.enhCode || smtpErr.Message != tc.want {
+			t.Errorf("toSMTPErr(%q) = %v %v %q, want %v %v %q", tc.msg, smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message, tc.code, tc.enhCode, tc.want)
+		}
+	}
+
+	if err := toSMTPErr(io.EOF); err != io.EOF {
+		t.Errorf("toSMTPErr(io.EOF) = %v", err)
+	}
+}
+
+func TestDialWithDialer(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Accept error: %v", err)
+			return
+		}
+		defer conn.Close()
+		remote <- conn.RemoteAddr()
+
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 hello world")
+		tc.ReadLine()
+	}()
+
+	localAddr := &net.TCPAddr{IP: ln.Addr().(*net.TCPAddr).IP}
+	d := &net.Dialer{LocalAddr: localAddr, Timeout: 5 * time.Second}
+	c, err := DialWithDialer(d, ln.Addr().String())
+	if err != nil {
+		t.Fatalf("DialWithDialer: %v", err)
+	}
+	if addr := (<-remote).(*net.TCPAddr); !addr.IP.Equal(localAddr.IP) {
+		t.Errorf("Expected source address %v, got %v", localAddr.IP, addr.IP)
+	}
+	c.Close()
+}
@@ -0,0 +1,118 @@
+package smtpclient
+
+import (
+	"sync"
+	"time"
+)
+
+// A Pool keeps idle client connections for reuse, keyed by the address of
+// the server. It is safe for concurrent use. Connections are checked with
+// RSET before they are handed out again.
+type Pool struct {
+	// Dial creates a new Client connected to addr. If nil, Dial is used.
+	Dial func(addr string) (*Client, error)
+	// MaxIdlePerHost is the maximum number of idle connections kept per
+	// address. If zero, DefaultMaxIdlePerHost is used.
+	MaxIdlePerHost int
+	// IdleTimeout is the time after which idle connections are closed.
+	// Zero means no limit.
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]*idleClient
+	closed bool
+}
+
+// DefaultMaxIdlePerHost is the default value of Pool.MaxIdlePerHost.
+const DefaultMaxIdlePerHost = 2
+
+type idleClient struct {
+	c     *Client
+	since time.Time
+}
+
+// Get returns an idle connection to addr if there is a live one, otherwise
+// it dials a new connection.
+func (p *Pool) Get(addr string) (*Client, error) {
+	for {
+		c := p.popIdle(addr)
+		if c == nil {
+			break
+		}
+		if err := c.Reset(); err != nil {
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+
+	dial := p.Dial
+	if dial == nil {
+		dial = Dial
+	}
+	c, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.poolAddr = addr
+	return c, nil
+}
+
+// popIdle removes the most recently used connection to addr from the pool.
+// Connections idle for longer than IdleTimeout are closed.
+func (p *Pool) popIdle(addr string) *Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for clients := p.idle[addr]; len(clients) > 0; clients = p.idle[addr] {
+		ic := clients[len(clients)-1]
+		p.idle[addr] = clients[:len(clients)-1]
+		if p.IdleTimeout > 0 && time.Since(ic.since) > p.IdleTimeout {
+			ic.c.Close()
+			continue
+		}
+		return ic.c
+	}
+	return nil
+}
+
+// Put returns a connection obtained by Get to the pool. The connection is
+// closed if it wasn't obtained by Get, the pool is closed or already holds
+// MaxIdlePerHost connections to the same address.
+func (p *Pool) Put(c *Client) {
+	max := p.MaxIdlePerHost
+	if max <= 0 {
+		max = DefaultMaxIdlePerHost
+	}
+
+	p.mu.Lock()
+	if c.poolAddr == "" || p.closed || len(p.idle[c.poolAddr]) >= max {
+		p.mu.Unlock()
+		c.Quit()
+		c.Close()
+		return
+	}
+	if p.idle == nil {
+		p.idle = make(map[string][]*idleClient)
+	}
+	p.idle[c.poolAddr] = append(p.idle[c.poolAddr], &idleClient{c: c, since: time.Now()})
+	p.mu.Unlock()
+}
+
+// Close closes all idle connections. Connections returned with Put after
+// Close are closed as well.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	for _, clients := range idle {
+		for _, ic := range clients {
+			ic.c.Quit()
+			ic.c.Close()
+		}
+	}
+	return nil
+}
@@ -24,3 +24,8 @@ func validateLine(line string) error {
 	}
 	return nil
 }
+
+// isLocalhost reports whether host is the local machine.
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
@@ -0,0 +1,60 @@
+package smtptest_test
+
+import (
+	"fmt"
+	"log"
+	"net/textproto"
+	"strings"
+
+	"github.com/mschneider82/go-smtp"
+	"github.com/mschneider82/go-smtp/smtpclient"
+	"github.com/mschneider82/go-smtp/smtptest"
+)
+
+func ExampleServer() {
+	s := smtptest.NewServer()
+	defer s.Close()
+
+	msg := strings.NewReader("Subject: Hello\r\n" +
+		"\r\n" +
+		"Hello World\r\n")
+	err := smtpclient.SendMail(s.Addr, nil, "sender@example.org", []string{"recipient@example.net"}, msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, m := range s.Messages() {
+		fmt.Println(m.From, m.To)
+		fmt.Printf("%q\n", m.Data)
+	}
+	// Output:
+	// sender@example.org [recipient@example.net]
+	// "Subject: Hello\r\n\r\nHello World\r\n"
+}
+
+func ExampleServeConn() {
+	conn, done := smtptest.ServeConn(smtp.NewDefaultBackend(nil))
+	defer done()
+
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		log.Fatal(err)
+	}
+	id, err := text.Cmd("EHLO localhost")
+	if err != nil {
+		log.Fatal(err)
+	}
+	text.StartResponse(id)
+	_, msg, err := text.ReadResponse(250)
+	text.EndResponse(id)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(msg)
+	// Output:
+	// Hello localhost
+	// 8BITMIME
+	// AUTH PLAIN
+	// ENHANCEDSTATUSCODES
+	// PIPELINING
+}
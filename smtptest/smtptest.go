@@ -0,0 +1,159 @@
+// Package smtptest provides a SMTP server recording the received messages,
+// for use in end-to-end tests of SMTP clients.
+package smtptest
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/mschneider82/go-smtp"
+)
+
+// A Message is a message received by the Server.
+type Message struct {
+	// Username is set if the client authenticated
+	Username string
+	From     string
+	To       []string
+	Data     []byte
+}
+
+// A Server is a SMTP server listening on a system-chosen port on the local
+// loopback interface, for use in end-to-end tests.
+type Server struct {
+	// Addr is the address of the server, of the form "127.0.0.1:1234".
+	Addr string
+
+	srv      *smtp.Server
+	wg       sync.WaitGroup
+	locker   sync.Mutex
+	messages []*Message
+}
+
+// NewServer starts and returns a new Server. The caller should call Close when
+// finished, to shut it down. The options are passed to smtp.NewServer, by
+// default the server allows insecure authentication with any credentials.
+func NewServer(opts ...smtp.Option) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("smtptest: failed to listen on a port: " + err.Error())
+	}
+
+	s := &Server{Addr: l.Addr().String()}
+	opts = append([]smtp.Option{
+		smtp.Domain("localhost"),
+		smtp.AllowInsecureAuth(),
+	}, opts...)
+	s.srv = smtp.NewServer(&backend{s: s}, opts...)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.srv.Serve(l)
+	}()
+	return s
+}
+
+// Messages returns the messages received so far.
+func (s *Server) Messages() []Message {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	msgs := make([]Message, 0, len(s.messages))
+	for _, msg := range s.messages {
+		msgs = append(msgs, *msg)
+	}
+	return msgs
+}
+
+// Close shuts down the server and blocks until it stopped serving.
+func (s *Server) Close() {
+	s.srv.Close()
+	s.wg.Wait()
+}
+
+// ServeConn serves a single connection of a new smtp.Server with the backend
+// be over an in-memory pipe, without opening a socket. It returns the client
+// end of the pipe and a function which closes the connection and blocks
+// until the server stopped serving it. The options are passed to
+// smtp.NewServer like with NewServer.
+func ServeConn(be smtp.Backend, opts ...smtp.Option) (net.Conn, func()) {
+	opts = append([]smtp.Option{
+		smtp.Domain("localhost"),
+		smtp.AllowInsecureAuth(),
+	}, opts...)
+	srv := smtp.NewServer(be, opts...)
+
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.ServeConn(serverConn)
+	}()
+
+	return clientConn, func() {
+		clientConn.Close()
+		srv.Close()
+		<-done
+	}
+}
+
+func (s *Server) record(msg *Message) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	s.messages = append(s.messages, msg)
+}
+
+type backend struct {
+	s *Server
+}
+
+func (be *backend) Login(_ *smtp.ConnectionState, username, password string) (smtp.Session, error) {
+	return &session{s: be.s, username: username}, nil
+}
+
+func (be *backend) AnonymousLogin(_ *smtp.ConnectionState) (smtp.Session, error) {
+	return &session{s: be.s}, nil
+}
+
+type session struct {
+	s        *Server
+	username string
+	from     string
+	to       []string
+}
+
+func (s *session) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string) error {
+	s.from = from
+	return nil
+}
+
+func (s *session) Rcpt(to string) error {
+	s.to = append(s.to, to)
+	return nil
+}
+
+func (s *session) Data(r io.Reader, d smtp.DataContext) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.s.record(&Message{
+		Username: s.username,
+		From:     s.from,
+		To:       s.to,
+		Data:     b,
+	})
+	return nil
+}
@@ -0,0 +1,45 @@
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// SpoolReader reads r into memory up to maxMem bytes and spills the rest into
+// a temporary file. It allows backends to re-read large messages without
+// buffering them in memory. The returned cleanup function must be called once
+// the reader is no longer used, it removes the temporary file.
+func SpoolReader(r io.Reader, maxMem int) (io.ReadSeeker, func(), error) {
+	return spool(r, int64(maxMem))
+}
+
+func spool(r io.Reader, maxMem int64) (io.ReadSeeker, func(), error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, maxMem+1)
+	if err == io.EOF || (err == nil && n <= maxMem) {
+		return bytes.NewReader(buf.Bytes()), func() {}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := ioutil.TempFile("", "smtp-spool-")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	if _, err := io.Copy(f, io.MultiReader(&buf, r)); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return f, cleanup, nil
+}
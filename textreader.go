@@ -7,6 +7,7 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -22,8 +23,24 @@ type Reader struct {
 	R   *bufio.Reader
 	dot *dotReader
 	buf []byte // a re-usable buffer for readContinuedLineSlice
+
+	// maxLineLength limits the length of a line, 0 means unlimited
+	maxLineLength int
+	// rejectBareLF makes ReadLine fail for lines not terminated by CRLF
+	rejectBareLF bool
+	// strictDot makes dot-encoded data start new lines only after CRLF,
+	// so that the data must end with <CR><LF>.<CR><LF>
+	strictDot bool
 }
 
+// ErrLineTooLong is returned when a line exceeds the maximum line length.
+// The rest of the line is discarded.
+var ErrLineTooLong = errors.New("line too long")
+
+// ErrBareLF is returned when a line is terminated by a bare LF instead of
+// CRLF and bare LFs are rejected. The line is discarded.
+var ErrBareLF = errors.New("bare LF line ending")
+
 // NewReader returns a new Reader reading from r.
 //
 // To avoid denial of service attacks, the provided bufio.Reader
@@ -55,11 +72,32 @@ func (r *Reader) ReadLineBytes() ([]byte, error) {
 func (r *Reader) readLineSlice() ([]byte, error) {
 	r.closeDot()
 	var line []byte
+	tooLong := false
 	for {
-		l, more, err := r.R.ReadLine()
+		var l []byte
+		var more, bareLF bool
+		var err error
+		if r.rejectBareLF {
+			l, more, bareLF, err = r.readLineCRLF()
+		} else {
+			l, more, err = r.R.ReadLine()
+		}
 		if err != nil {
 			return nil, err
 		}
+		if bareLF {
+			return nil, ErrBareLF
+		}
+		if r.maxLineLength > 0 && len(line)+len(l) > r.maxLineLength {
+			// Discard the rest of the line
+			tooLong = true
+		}
+		if tooLong {
+			if !more {
+				return nil, ErrLineTooLong
+			}
+			continue
+		}
 		// Avoid the copy if the first call produced a full line.
 		if line == nil && !more {
 			return l, nil
@@ -72,6 +110,30 @@ func (r *Reader) readLineSlice() ([]byte, error) {
 	return line, nil
 }
 
+// readLineCRLF is like bufio.Reader.ReadLine, but it also reports whether
+// the line was terminated by a bare LF.
+func (r *Reader) readLineCRLF() (line []byte, more, bareLF bool, err error) {
+	line, err = r.R.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Handle the case where "\r\n" straddles the buffer.
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			r.R.UnreadByte()
+			line = line[:len(line)-1]
+		}
+		return line, true, false, nil
+	}
+	if len(line) == 0 {
+		return nil, false, false, err
+	}
+	if line[len(line)-1] == '\n' {
+		if len(line) < 2 || line[len(line)-2] != '\r' {
+			return line[:len(line)-1], false, true, nil
+		}
+		line = line[:len(line)-2]
+	}
+	return line, false, false, nil
+}
+
 // ReadContinuedLine reads a possibly continued line from r,
 // eliding the final trailing ASCII white space.
 // Lines after the first are considered continuations if they
@@ -213,7 +275,7 @@ func parseCodeLine(line string, expectCode int) (code int, continued bool, messa
 	if 1 <= expectCode && expectCode < 10 && code/100 != expectCode ||
 		10 <= expectCode && expectCode < 100 && code/10 != expectCode ||
 		100 <= expectCode && expectCode < 1000 && code != expectCode {
-		err = &textproto.Error{code, message}
+		err = &textproto.Error{Code: code, Msg: message}
 	}
 	return
 }
@@ -289,7 +351,7 @@ func (r *Reader) ReadResponse(expectCode int) (code int, message string, err err
 	}
 	if err != nil && multi && message != "" {
 		// replace one line error message with all lines (full message)
-		err = &textproto.Error{code, message}
+		err = &textproto.Error{Code: code, Msg: message}
 	}
 	return
 }
@@ -307,24 +369,34 @@ func (r *Reader) ReadResponse(expectCode int) (code int, message string, err err
 // looking like the end of the sequence.
 //
 // The decoded form returned by the Reader's Read method
-// rewrites the "\r\n" line endings into the simpler "\n",
-// removes leading dot escapes if present, and stops with error io.EOF
-// after consuming (and discarding) the end-of-sequence line.
+// keeps the "\r\n" line endings, normalizes bare "\n" line endings
+// into "\r\n", removes leading dot escapes if present, and stops with
+// error io.EOF after consuming (and discarding) the end-of-sequence line.
 func (r *Reader) DotReader2() io.Reader {
+	return r.dotReader()
+}
+
+func (r *Reader) dotReader() *dotReader {
 	r.closeDot()
-	r.dot = &dotReader{r: r}
+	r.dot = &dotReader{r: r, strict: r.strictDot}
 	return r.dot
 }
 
 type dotReader struct {
 	r     *Reader
 	state int
+	lf    bool // \n of a normalized bare LF still has to be emitted
+	// bareLF is set once a line terminated by a bare LF has been read
+	bareLF bool
+	// strict is set if a bare LF doesn't start a new line, i.e. neither
+	// a leading dot nor the end marker is recognized after it
+	strict bool
 }
 
 // Read satisfies reads by decoding dot-encoded data read from d.r.
 func (d *dotReader) Read(b []byte) (n int, err error) {
 	// Run data through a simple state machine to
-	// elide leading dots, rewrite trailing \r\n into \n,
+	// elide leading dots, rewrite bare \n into \r\n,
 	// and detect ending .\r\n line.
 	const (
 		stateBeginLine = iota // beginning of line; initial state; must be zero
@@ -336,6 +408,16 @@ func (d *dotReader) Read(b []byte) (n int, err error) {
 	)
 	br := d.r.R
 	for n < len(b) && d.state != stateEOF {
+		if d.lf {
+			b[n] = '\n'
+			n++
+			d.lf = false
+			d.state = stateBeginLine
+			if d.strict {
+				d.state = stateData
+			}
+			continue
+		}
 		var c byte
 		c, err = br.ReadByte()
 		if err != nil {
@@ -350,22 +432,17 @@ func (d *dotReader) Read(b []byte) (n int, err error) {
 				d.state = stateDot
 				continue
 			}
-			if c == '\r' {
-				d.state = stateCR
-				//continue
-			}
-			d.state = stateData
 
 		case stateDot:
 			if c == '\r' {
 				d.state = stateDotCR
 				continue
 			}
-			if c == '\n' {
+			if c == '\n' && !d.strict {
+				d.bareLF = true
 				d.state = stateEOF
 				continue
 			}
-			d.state = stateData
 
 		case stateDotCR:
 			if c == '\n' {
@@ -376,26 +453,26 @@ func (d *dotReader) Read(b []byte) (n int, err error) {
 			// Consume leading dot and emit saved \r.
 			br.UnreadByte()
 			c = '\r'
-			d.state = stateData
 
 		case stateCR:
 			if c == '\n' {
+				b[n] = c
+				n++
 				d.state = stateBeginLine
-				break
+				continue
 			}
-			// Not part of \r\n. Emit saved \r
-			br.UnreadByte()
+		}
+
+		switch c {
+		case '\r':
+			d.state = stateCR
+		case '\n':
+			// Bare LF, emit \r now and the \n on the next iteration
+			d.bareLF = true
+			d.lf = true
 			c = '\r'
+		default:
 			d.state = stateData
-
-		case stateData:
-			if c == '\r' {
-				d.state = stateCR
-				//continue // keep \r in lines
-			}
-			if c == '\n' {
-				d.state = stateBeginLine
-			}
 		}
 		b[n] = c
 		n++
@@ -831,6 +908,16 @@ func NewTextConn(conn io.ReadWriteCloser) *TextConn {
 	}
 }
 
+// NewTextConnSize is like NewTextConn, but the buffers of the reader and the
+// writer have at least the given sizes.
+func NewTextConnSize(conn io.ReadWriteCloser, readSize, writeSize int) *TextConn {
+	return &TextConn{
+		Reader: Reader{R: bufio.NewReaderSize(conn, readSize)},
+		Writer: textproto.Writer{W: bufio.NewWriterSize(conn, writeSize)},
+		conn:   conn,
+	}
+}
+
 // Close closes the connection.
 func (c *TextConn) Close() error {
 	return c.conn.Close()